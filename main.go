@@ -1,10 +1,125 @@
 package main
 
-import "github.com/map34/simple_tftp/tftputils"
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/map34/simple_tftp/tftputils"
+	"github.com/sirupsen/logrus"
+)
 
 func main() {
-	err := tftputils.SpawnServeSession()
+	config := tftputils.NewServerConfig()
+	flag.Var(&config.Addresses, "addr", "UDP address to listen on, repeatable, e.g. 0.0.0.0:69 or [::]:69 (default a random localhost port)")
+	flag.Var(config.ReadACL, "read-acl", "\"allow|deny CIDR [prefix]\" rule for read requests, repeatable")
+	flag.Var(config.WriteACL, "write-acl", "\"allow|deny CIDR [prefix]\" rule for write requests, repeatable")
+	flag.BoolVar(&config.Permissions.ReadOnly, "read-only", false, "reject all write requests")
+	flag.BoolVar(&config.Permissions.WriteOnly, "write-only", false, "reject all read requests")
+	flag.Var(config.Permissions, "path-perm", "\"pattern none|ro|wo|rw\" permission for matching files, repeatable")
+	flag.IntVar(&config.MaxSessions, "max-sessions", 0, "maximum concurrent transfers, 0 is unlimited")
+	flag.IntVar(&config.MaxClientSessions, "max-client-sessions", 0, "maximum concurrent transfers per client ip, 0 is unlimited")
+	flag.Float64Var(&config.RequestRate, "request-rate", 0, "maximum requests per second, 0 is unlimited")
+	flag.IntVar(&config.RequestBurst, "request-burst", 0, "request burst size (default one second worth)")
+	flag.Float64Var(&config.ClientRequestRate, "client-request-rate", 0, "maximum requests per second per client ip, 0 is unlimited")
+	flag.IntVar(&config.ClientRequestBurst, "client-request-burst", 0, "request burst size per client ip (default one second worth)")
+	flag.IntVar(&config.SessionBandwidth, "session-bandwidth", 0, "bytes per second for each transfer, 0 is unlimited")
+	flag.DurationVar(&config.Timeout, "timeout", 5*time.Second, "how long a transfer waits for the client before sending its last packet again")
+	flag.IntVar(&config.Retries, "retries", 5, "how many times a packet is sent again before giving up on the client")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for running transfers on shutdown before aborting them")
+	flag.Var(&config.Roots, "root", "directory to serve files from before the uploaded ones, repeatable, searched in order")
+	flag.BoolVar(&config.Dedup, "dedup", false, "store identical files once, by their SHA-256")
+	flag.BoolVar(&config.VerifyReads, "verify-reads", false, "check every file read against its recorded checksums")
+	flag.Int64Var(&config.StoreLimits.MaxTotalBytes, "max-store-bytes", 0, "maximum bytes stored in total, 0 is unlimited")
+	flag.Int64Var(&config.StoreLimits.MaxFileBytes, "max-file-bytes", 0, "maximum size of a single file, 0 is unlimited")
+	flag.IntVar(&config.StoreLimits.MaxFiles, "max-files", 0, "maximum number of files stored, 0 is unlimited")
+	flag.StringVar(&config.Upstream, "upstream", "", "tftp://host[:port] or http(s) URL, {filename} standing for the file, to fetch missing files from")
+	flag.BoolVar(&config.UpstreamCache, "upstream-cache", false, "store the files fetched from upstream")
+	flag.DurationVar(&config.UpstreamTimeout, "upstream-timeout", 5*time.Second, "how long to wait for the upstream to answer, or to send more of a file")
+	flag.Int64Var(&config.CacheBytes, "cache-bytes", 0, "bytes of recently read files to keep in memory, 0 disables the cache")
+	flag.Var(config.Expiry, "expire", "\"pattern ttl [max-reads]\" expiry for matching files, repeatable")
+	flag.DurationVar(&config.ExpiryInterval, "expire-interval", time.Minute, "how often to delete expired files")
+	flag.Var(config.Rewriter, "rewrite", "\"flags regex [replacement]\" rule or \"alias name target\" for requested filenames, repeatable")
+	remap := flag.String("remap", "", "file of rewrite rules and aliases, one per line")
+	flag.BoolVar(&config.Rewriter.Backslashes, "backslashes", false, "turn backslashes in requested filenames into slashes")
+	flag.BoolVar(&config.Rewriter.StripLeadingSlash, "strip-slash", false, "strip the leading slashes of requested filenames")
+	flag.BoolVar(&config.Rewriter.CaseInsensitive, "ignore-case", false, "serve files whose name only differs in case from the one requested")
+	flag.StringVar(&config.SnapshotPath, "snapshot", "", "file to keep the stored files in across restarts")
+	flag.DurationVar(&config.SnapshotInterval, "snapshot-interval", time.Minute, "how often to save the snapshot, 0 only saves on shutdown")
+	flag.StringVar(&config.AdminAddress, "admin-addr", "", "TCP address to serve the HTTP admin API on, e.g. localhost:8069")
+	flag.StringVar(&config.HTTPAddress, "http-addr", "", "TCP address to serve the stored files over HTTP on, e.g. 0.0.0.0:80")
+	flag.Var(config.HTTPACL, "http-acl", "\"allow|deny CIDR [prefix]\" rule for HTTP requests, repeatable")
+	flag.BoolVar(&config.SinglePort, "single-port", false, "run every transfer over the listening port instead of a new port each")
+	flag.StringVar(&config.TransferPorts, "transfer-ports", "", "port range to run transfers on, e.g. 50000-50100 (default any ephemeral port)")
+	auditFile := flag.String("audit-file", "", "file to append a JSON line to for every transfer attempt")
+	auditMaxBytes := flag.Int64("audit-max-bytes", 100<<20, "size the audit file is rotated at, 0 never rotates it")
+	auditMaxFiles := flag.Int("audit-max-files", 10, "rotated audit files kept, 0 keeps them all")
+	auditSyslog := flag.String("audit-syslog", "", "record every transfer attempt to syslog, \"local\" or network://host:port such as udp://10.0.0.5:514")
+	flag.StringVar(&config.TraceDir, "trace-dir", "", "directory to write a trace of every packet of each session to")
+	flag.StringVar(&config.TraceFormat, "trace-format", "pcap", "format of the packet traces, pcap or text")
+	flag.Var(config.TraceClients, "trace-client", "\"allow|deny CIDR [prefix]\" rule for the sessions traced, repeatable (default every session)")
+	logFormat := flag.String("log-format", "text", "log output format, text or json")
+	logLevel := flag.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+	flag.IntVar(&config.BatchSize, "batch-size", 0, "datagrams received per system call on Linux, and sent at once in single port mode (default one at a time)")
+	flag.Parse()
+
+	if err := tftputils.ConfigureLogrus(logrus.StandardLogger(), *logFormat, *logLevel); err != nil {
+		panic(err)
+	}
+
+	if *remap != "" {
+		if err := config.Rewriter.LoadRules(*remap); err != nil {
+			panic(err)
+		}
+	}
+
+	audit := tftputils.AuditSinks{}
+	if *auditFile != "" {
+		sink, err := tftputils.NewFileAuditSink(*auditFile, *auditMaxBytes, *auditMaxFiles)
+		if err != nil {
+			panic(err)
+		}
+		audit = append(audit, sink)
+	}
+	if *auditSyslog != "" {
+		network, address, _ := strings.Cut(*auditSyslog, "://")
+		if *auditSyslog == "local" {
+			network, address = "", ""
+		}
+		sink, err := tftputils.NewSyslogAuditSink(network, address, "simple_tftp")
+		if err != nil {
+			panic(err)
+		}
+		audit = append(audit, sink)
+	}
+	if len(audit) > 0 {
+		config.Audit = audit
+	}
+
+	server, err := tftputils.NewServeSession(config)
+	if err != nil {
+		panic(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		<-signals
+		if err := server.Shutdown(); err != nil {
+			logrus.Errorf("Cannot shut down cleanly: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	err = server.Serve()
 	if err != nil {
 		panic(err)
 	}
+	// Serving stops as soon as the shutdown begins,
+	// the running transfers and the snapshot are waited for
+	<-shutdown
 }
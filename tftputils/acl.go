@@ -0,0 +1,140 @@
+package tftputils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACLRule allows or denies requests coming from a client subnet,
+// optionally only for filenames starting with a given prefix.
+// Filenames are cleaned as the storage does before matching,
+// so "./secret/key" starts with "secret/" as well.
+type ACLRule struct {
+	allow   bool
+	network *net.IPNet
+	prefix  string
+}
+
+// ACL holds an ordered list of rules, the first matching rule decides.
+// When no rule matches, the request is denied if the list contains
+// any allow rule and allowed otherwise.
+type ACL struct {
+	rules []*ACLRule
+}
+
+func NewACL() *ACL {
+	return &ACL{
+		rules: []*ACLRule{},
+	}
+}
+
+// ParseACLRule parses a rule in the form of "allow|deny CIDR [prefix]",
+// a bare IP address is treated as a single host network.
+func ParseACLRule(rule string) (*ACLRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("Malformed ACL rule: %q", rule)
+	}
+
+	var allow bool
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		allow = true
+	case "deny":
+		allow = false
+	default:
+		return nil, fmt.Errorf("Unknown ACL action: %v", fields[0])
+	}
+
+	network, err := parseNetwork(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if len(fields) == 3 {
+		prefix = strings.TrimLeft(fields[2], "/")
+	}
+	return &ACLRule{
+		allow:   allow,
+		network: network,
+		prefix:  prefix,
+	}, nil
+}
+
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address: %v", cidr)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+func (r *ACLRule) matches(ip net.IP, filename string) bool {
+	return r.network.Contains(ip) && strings.HasPrefix(cleanFilename(filename), r.prefix)
+}
+
+func (r *ACLRule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	if r.prefix == "" {
+		return fmt.Sprintf("%v %v", action, r.network)
+	}
+	return fmt.Sprintf("%v %v %v", action, r.network, r.prefix)
+}
+
+// AddRule parses and appends a rule to the end of the list
+func (acl *ACL) AddRule(rule string) error {
+	parsed, err := ParseACLRule(rule)
+	if err != nil {
+		return err
+	}
+	acl.rules = append(acl.rules, parsed)
+	return nil
+}
+
+// IsAllowed determines whether a client ip may access a filename.
+// A nil or empty ACL allows everything.
+func (acl *ACL) IsAllowed(ip net.IP, filename string) bool {
+	if acl == nil {
+		return true
+	}
+
+	hasAllowRule := false
+	for _, rule := range acl.rules {
+		if rule.matches(ip, filename) {
+			return rule.allow
+		}
+		hasAllowRule = hasAllowRule || rule.allow
+	}
+	return !hasAllowRule
+}
+
+// String and Set let an ACL be used as a repeatable command line flag
+func (acl *ACL) String() string {
+	if acl == nil {
+		return ""
+	}
+	rules := make([]string, len(acl.rules))
+	for i, rule := range acl.rules {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (acl *ACL) Set(rule string) error {
+	return acl.AddRule(rule)
+}
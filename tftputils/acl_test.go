@@ -0,0 +1,99 @@
+package tftputils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseACLRule(t *testing.T) {
+	rule, err := ParseACLRule("allow 10.0.0.0/8 boot/")
+	assert.Nil(t, err)
+	assert.Equal(t, "allow 10.0.0.0/8 boot/", rule.String())
+
+	rule, err = ParseACLRule("deny 192.168.1.7")
+	assert.Nil(t, err)
+	assert.Equal(t, "deny 192.168.1.7/32", rule.String())
+}
+
+func TestParseACLRuleBad(t *testing.T) {
+	_, err := ParseACLRule("permit 10.0.0.0/8")
+	assert.NotNil(t, err)
+
+	_, err = ParseACLRule("allow not-a-network")
+	assert.NotNil(t, err)
+
+	_, err = ParseACLRule("allow")
+	assert.NotNil(t, err)
+}
+
+func TestEmptyACLAllows(t *testing.T) {
+	var nilACL *ACL
+	assert.True(t, nilACL.IsAllowed(net.ParseIP("10.0.0.1"), "hi"))
+	assert.True(t, NewACL().IsAllowed(net.ParseIP("10.0.0.1"), "hi"))
+}
+
+func TestACLAllowList(t *testing.T) {
+	acl := NewACL()
+	assert.Nil(t, acl.Set("allow 10.1.0.0/16"))
+	assert.Nil(t, acl.Set("allow 10.9.0.0/24 configs/"))
+
+	assert.True(t, acl.IsAllowed(net.ParseIP("10.1.3.4"), "pxelinux.0"))
+	assert.True(t, acl.IsAllowed(net.ParseIP("10.9.0.4"), "configs/a"))
+	assert.False(t, acl.IsAllowed(net.ParseIP("10.9.0.4"), "pxelinux.0"))
+	assert.False(t, acl.IsAllowed(net.ParseIP("172.16.0.1"), "pxelinux.0"))
+}
+
+func TestACLDenyList(t *testing.T) {
+	acl := NewACL()
+	assert.Nil(t, acl.Set("deny 10.66.0.0/16"))
+	assert.Nil(t, acl.Set("deny fe80::/10"))
+
+	assert.False(t, acl.IsAllowed(net.ParseIP("10.66.0.1"), "hi"))
+	assert.False(t, acl.IsAllowed(net.ParseIP("fe80::1"), "hi"))
+	assert.True(t, acl.IsAllowed(net.ParseIP("10.1.0.1"), "hi"))
+}
+
+func TestACLCleansFilenames(t *testing.T) {
+	acl := NewACL()
+	assert.Nil(t, acl.Set("deny 127.0.0.0/8 secret/"))
+	assert.Nil(t, acl.Set("deny 127.0.0.0/8 /private/"))
+
+	client := net.ParseIP("127.0.0.1")
+	for _, filename := range []string{"secret/key", "/secret/key", "./secret/key", "x/../secret/key", "secret//key", "private/key"} {
+		assert.False(t, acl.IsAllowed(client, filename), filename)
+	}
+	assert.True(t, acl.IsAllowed(client, "public/key"))
+}
+
+func TestACLFirstMatchWins(t *testing.T) {
+	acl := NewACL()
+	assert.Nil(t, acl.Set("deny 10.1.2.3"))
+	assert.Nil(t, acl.Set("allow 10.1.0.0/16"))
+
+	assert.False(t, acl.IsAllowed(net.ParseIP("10.1.2.3"), "hi"))
+	assert.True(t, acl.IsAllowed(net.ParseIP("10.1.2.4"), "hi"))
+}
+
+func TestRefusalNotSentKeepsServing(t *testing.T) {
+	config := NewServerConfig()
+	assert.Nil(t, config.ReadACL.Set("deny 127.0.0.0/8"))
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	// The refusal can't be sent over a closed socket,
+	// which mustn't be taken as the server failing
+	listener := server.listeners[0]
+	listener.udpUtils.connection.Close()
+	packet := &Packet{
+		Data:   createRequestPacket(RRQ, "boot/pxelinux.0", OCTET),
+		Remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000},
+	}
+	handled, err := server.ResolvePacket(listener, packet)
+	assert.True(t, handled)
+	assert.Nil(t, err)
+}
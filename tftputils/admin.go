@@ -0,0 +1,345 @@
+package tftputils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminFilesPath    = "/files"
+	adminSessionsPath = "/sessions"
+	adminVerifyPath   = "/verify"
+	adminCachePath    = "/cache"
+)
+
+// AdminHandler serves an HTTP/JSON API to inspect and manage
+// the file storage and the running transfers of a server.
+//
+//	GET    /files           list stored files
+//	GET    /files/{name}    download a file
+//	PUT    /files/{name}    upload or overwrite a file
+//	DELETE /files/{name}    delete a file
+//	POST   /verify          check every stored file against its checksums
+//	GET    /cache           hit and miss counts of the read cache
+//	GET    /sessions        list running transfers
+//	DELETE /sessions/{id}   abort a running transfer
+type AdminHandler struct {
+	fileStorage Storage
+	transfers   *TransferRegistry
+	// cache is the read cache of the storage, if any
+	cache *CachingStorage
+	// limits bound the size of the files uploaded
+	// before they are read into memory
+	limits StoreLimits
+	logger Logger
+}
+
+func NewAdminHandler(fileS Storage, transfers *TransferRegistry) *AdminHandler {
+	return &AdminHandler{
+		fileStorage: fileS,
+		transfers:   transfers,
+		logger:      defaultLogger,
+	}
+}
+
+// FileInfo describes a stored file in the admin API, with its metadata
+// and its checksums in hexadecimal. Checksums are left out until known,
+// as for the files of root directories that were never read.
+type FileInfo struct {
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	SHA256      string     `json:"sha256,omitempty"`
+	CRC32       string     `json:"crc32,omitempty"`
+	Created     time.Time  `json:"created"`
+	Modified    time.Time  `json:"modified"`
+	Uploader    string     `json:"uploader,omitempty"`
+	Mode        string     `json:"mode,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	MaxReads    int        `json:"max_reads,omitempty"`
+}
+
+// newFileInfo describes a file without reading its content,
+// listing files must not hash every one of them
+func newFileInfo(file *FileObject) *FileInfo {
+	metadata := file.Metadata()
+	info := &FileInfo{
+		Name:        file.filename,
+		Size:        file.Size(),
+		Created:     metadata.Created,
+		Modified:    metadata.Modified,
+		Uploader:    metadata.Uploader,
+		Mode:        metadata.Mode,
+		ContentType: metadata.ContentType,
+		MaxReads:    metadata.MaxReads,
+	}
+	if !metadata.Expires.IsZero() {
+		info.Expires = &metadata.Expires
+	}
+	if digest, crc, ok := file.knownChecksums(); ok {
+		info.SHA256 = hex.EncodeToString(digest[:])
+		info.CRC32 = fmt.Sprintf("%08x", crc)
+	}
+	return info
+}
+
+// uploadMetadata returns the metadata of a file uploaded through the API,
+// with its expiry from the optional "ttl" and "max-reads" query parameters
+func uploadMetadata(r *http.Request) (FileMetadata, error) {
+	metadata := FileMetadata{Mode: "http"}
+	query := r.URL.Query()
+	if value := query.Get("ttl"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return metadata, fmt.Errorf("Malformed time to live: %v", value)
+		}
+		metadata.Expires = time.Now().Add(ttl)
+	}
+	if value := query.Get("max-reads"); value != "" {
+		maxReads, err := strconv.Atoi(value)
+		if err != nil || maxReads <= 0 {
+			return metadata, fmt.Errorf("Malformed read count: %v", value)
+		}
+		metadata.MaxReads = maxReads
+	}
+	return metadata, nil
+}
+
+// VerifyReport lists the stored files failing verification
+type VerifyReport struct {
+	Verified  int      `json:"verified"`
+	Corrupted []string `json:"corrupted"`
+}
+
+// TransferInfo describes a running transfer in the admin API,
+// Size is -1 when the size of an upload isn't known yet
+type TransferInfo struct {
+	ID          uint64    `json:"id"`
+	Direction   string    `json:"direction"`
+	Filename    string    `json:"filename"`
+	Client      string    `json:"client"`
+	Started     time.Time `json:"started"`
+	Transferred int64     `json:"transferred"`
+	Size        int64     `json:"size"`
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == adminFilesPath:
+		h.handleFiles(w, r)
+	case strings.HasPrefix(path, adminFilesPath+"/"):
+		h.handleFile(w, r, strings.TrimPrefix(path, adminFilesPath+"/"))
+	case path == adminSessionsPath:
+		h.handleSessions(w, r)
+	case strings.HasPrefix(path, adminSessionsPath+"/"):
+		h.handleSession(w, r, strings.TrimPrefix(path, adminSessionsPath+"/"))
+	case path == adminVerifyPath:
+		h.handleVerify(w, r)
+	case path == adminCachePath && h.cache != nil:
+		h.handleCache(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *AdminHandler) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	files := h.fileStorage.Files()
+	infos := make([]*FileInfo, len(files))
+	for i, file := range files {
+		infos[i] = newFileInfo(file)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *AdminHandler) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.cache.Stats())
+}
+
+func (h *AdminHandler) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	report := &VerifyReport{Corrupted: []string{}}
+	for _, file := range h.fileStorage.Files() {
+		report.Verified++
+		err := file.Verify()
+		file.Close()
+		if err != nil {
+			h.logger.Errorf("%v", err)
+			report.Corrupted = append(report.Corrupted, file.filename)
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (h *AdminHandler) handleFile(w http.ResponseWriter, r *http.Request, filename string) {
+	switch r.Method {
+	case http.MethodGet:
+		file, err := h.fileStorage.Get(filename)
+		if err != nil && h.fileStorage.DoesFileExist(filename) {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		defer file.Close()
+		// Only a recorded digest is sent, computing one would read the file twice
+		if digest, _, ok := file.knownChecksums(); ok {
+			w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+		}
+		contentType := file.Metadata().ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size(), 10))
+		io.Copy(w, file.NewReader())
+	case http.MethodPut:
+		metadata, err := uploadMetadata(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		maxBytes := h.maxUploadBytes()
+		if maxBytes > 0 && r.ContentLength > maxBytes {
+			err := fmt.Errorf("File size %v exceeds the limit of %v bytes", r.ContentLength, maxBytes)
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		body := r.Body
+		if maxBytes > 0 {
+			body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		data, err := ioutil.ReadAll(body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err := fmt.Errorf("File exceeds the limit of %v bytes", maxBytes)
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		file := NewFileObject(filename, data)
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			metadata.Uploader = host
+		}
+		file.SetMetadata(metadata)
+		err = h.fileStorage.Replace(file)
+		if IsQuotaError(err) {
+			writeJSONError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		h.logger.Infof("Stored %v (%v bytes)", filename, len(data))
+		writeJSON(w, http.StatusOK, newFileInfo(file))
+	case http.MethodDelete:
+		err := h.fileStorage.Delete(filename)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		h.logger.Infof("Deleted %v", filename)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// maxUploadBytes returns the most bytes an upload may hold,
+// zero when the storage limits don't bound it
+func (h *AdminHandler) maxUploadBytes() int64 {
+	maxBytes := h.limits.MaxFileBytes
+	if total := h.limits.MaxTotalBytes; total > 0 && (maxBytes == 0 || total < maxBytes) {
+		maxBytes = total
+	}
+	return maxBytes
+}
+
+func (h *AdminHandler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	transfers := h.transfers.List()
+	infos := make([]*TransferInfo, len(transfers))
+	for i, transfer := range transfers {
+		infos[i] = &TransferInfo{
+			ID:          transfer.ID,
+			Direction:   transfer.Direction,
+			Filename:    transfer.Filename,
+			Client:      transfer.Client.String(),
+			Started:     transfer.Started,
+			Transferred: transfer.Transferred(),
+			Size:        transfer.Size(),
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *AdminHandler) handleSession(w http.ResponseWriter, r *http.Request, idString string) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	transfer, ok := h.transfers.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.logger.Infof("Aborting transfer %v of %v with %v", id, transfer.Filename, transfer.Client)
+	transfer.Abort()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		defaultLogger.Errorf("Cannot encode response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,190 @@
+package tftputils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestAdminFiles(t *testing.T) {
+	_, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+	handler := NewAdminHandler(fileStorage, NewTransferRegistry())
+
+	response := adminRequest(handler, http.MethodPut, "/files/boot/pxelinux.0", "boot")
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = adminRequest(handler, http.MethodGet, "/files", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var infos []*FileInfo
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &infos))
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, "boot/pxelinux.0", infos[0].Name)
+		assert.Equal(t, int64(4), infos[0].Size)
+		assert.Equal(t, "4509beb0ab401d71fa4a5cd94a55c9a74f13332776ae4019c5bfc4c2005157ff", infos[0].SHA256)
+		assert.Equal(t, "46edaec4", infos[0].CRC32)
+		assert.Equal(t, "192.0.2.1", infos[0].Uploader)
+		assert.Equal(t, "http", infos[0].Mode)
+		assert.Equal(t, "text/plain; charset=utf-8", infos[0].ContentType)
+		assert.False(t, infos[0].Created.IsZero())
+		assert.Equal(t, "hello.txt", infos[1].Name)
+		assert.Equal(t, int64(3), infos[1].Size)
+	}
+
+	response = adminRequest(handler, http.MethodGet, "/files/boot/pxelinux.0", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "boot", response.Body.String())
+	assert.Equal(t, "SHA-256=RQm+sKtAHXH6SlzZSlXJp08TMyd2rkAZxb/EwgBRV/8=", response.Header().Get("Digest"))
+
+	response = adminRequest(handler, http.MethodDelete, "/files/boot/pxelinux.0", "")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	assert.False(t, fileStorage.DoesFileExist("boot/pxelinux.0"))
+
+	response = adminRequest(handler, http.MethodGet, "/files/boot/pxelinux.0", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestAdminFilesLeavesUnknownChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "boot.img"), []byte("boot"), 0644))
+	handler := NewAdminHandler(NewDirStore(dir), NewTransferRegistry())
+
+	// Listing doesn't read the files, the checksums
+	// of a file are only computed when it is read
+	response := adminRequest(handler, http.MethodGet, "/files", "")
+	var infos []*FileInfo
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &infos))
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "boot.img", infos[0].Name)
+		assert.Equal(t, int64(4), infos[0].Size)
+		assert.Empty(t, infos[0].SHA256)
+		assert.Empty(t, infos[0].CRC32)
+	}
+	assert.NotContains(t, response.Body.String(), "sha256")
+
+	// Nor does serving it, so no digest is known to send
+	response = adminRequest(handler, http.MethodGet, "/files/boot.img", "")
+	assert.Equal(t, "boot", response.Body.String())
+	assert.Empty(t, response.Header().Get("Digest"))
+}
+
+func TestAdminVerify(t *testing.T) {
+	fileStorage := NewFileStore()
+	data := []byte("boot")
+	assert.Nil(t, fileStorage.Put(NewFileObject("boot/pxelinux.0", data)))
+	assert.Nil(t, fileStorage.Put(NewFileObject("hello.txt", []byte("hello"))))
+	handler := NewAdminHandler(NewVerifyingStorage(fileStorage), NewTransferRegistry())
+
+	response := adminRequest(handler, http.MethodPost, "/verify", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var report VerifyReport
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &report))
+	assert.Equal(t, VerifyReport{Verified: 2, Corrupted: []string{}}, report)
+
+	// Flip a bit behind the back of the store
+	data[0] ^= 1
+	response = adminRequest(handler, http.MethodPost, "/verify", "")
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &report))
+	assert.Equal(t, VerifyReport{Verified: 2, Corrupted: []string{"boot/pxelinux.0"}}, report)
+
+	response = adminRequest(handler, http.MethodGet, "/files/boot/pxelinux.0", "")
+	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	response = adminRequest(handler, http.MethodGet, "/verify", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+}
+
+func TestAdminPutExpiry(t *testing.T) {
+	fileStorage := NewFileStore()
+	handler := NewAdminHandler(fileStorage, NewTransferRegistry())
+
+	response := adminRequest(handler, http.MethodPut, "/files/secrets/key?ttl=1h&max-reads=1", "key")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var info FileInfo
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &info))
+	assert.NotNil(t, info.Expires)
+	assert.Equal(t, 1, info.MaxReads)
+
+	response = adminRequest(handler, http.MethodPut, "/files/secrets/key?ttl=soon", "key")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestAdminPutOverQuota(t *testing.T) {
+	fileStorage := NewFileStore()
+	fileStorage.SetLimits(StoreLimits{MaxFileBytes: 2})
+	handler := NewAdminHandler(fileStorage, NewTransferRegistry())
+
+	response := adminRequest(handler, http.MethodPut, "/files/hello.txt", "hello")
+	assert.Equal(t, http.StatusInsufficientStorage, response.Code)
+}
+
+func TestAdminPutBoundsBody(t *testing.T) {
+	handler := NewAdminHandler(NewFileStore(), NewTransferRegistry())
+	handler.limits = StoreLimits{MaxFileBytes: 4}
+
+	response := adminRequest(handler, http.MethodPut, "/files/hello.txt", "hello")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+
+	// A body of unknown length is only read up to the limit
+	request := httptest.NewRequest(http.MethodPut, "/files/hello.txt", strings.NewReader("hello"))
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.False(t, handler.fileStorage.DoesFileExist("hello.txt"))
+
+	response = adminRequest(handler, http.MethodPut, "/files/hello.txt", "hell")
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestAdminSessions(t *testing.T) {
+	transfers := NewTransferRegistry()
+	handler := NewAdminHandler(NewFileStore(), transfers)
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+	transfer := NewTransfer(ReadDirection, &RequestInfo{filename: "hello.txt"}, client)
+	transfer.setSize(1024)
+	transfer.setTransferred(512)
+	transfers.Add(transfer)
+
+	aborted := false
+	transfer.onAbort(func() { aborted = true })
+
+	response := adminRequest(handler, http.MethodGet, "/sessions", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var infos []*TransferInfo
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &infos))
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "10.0.0.1:2000", infos[0].Client)
+		assert.Equal(t, int64(512), infos[0].Transferred)
+		assert.Equal(t, int64(1024), infos[0].Size)
+	}
+
+	response = adminRequest(handler, http.MethodDelete, "/sessions/1", "")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	assert.True(t, aborted)
+
+	response = adminRequest(handler, http.MethodDelete, "/sessions/2", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestAdminMethodNotAllowed(t *testing.T) {
+	handler := NewAdminHandler(NewFileStore(), NewTransferRegistry())
+	response := adminRequest(handler, http.MethodPost, "/files", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+}
@@ -0,0 +1,284 @@
+package tftputils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Results of the transfer attempts recorded by the audit trail
+const (
+	AuditSuccess = "success"
+	// AuditFailure is a transfer the server gave up on
+	AuditFailure = "failure"
+	// AuditAborted is a transfer the client gave up on
+	AuditAborted = "aborted"
+	// AuditRefused is a request refused before any transfer started
+	AuditRefused = "refused"
+)
+
+// AuditRecord describes a transfer attempt once it is over
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	SessionID uint64    `json:"session_id,omitempty"`
+	Client    string    `json:"client"`
+	Operation string    `json:"operation"`
+	Filename  string    `json:"filename"`
+	Result    string    `json:"result"`
+	Bytes     int64     `json:"bytes"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	SHA256   string  `json:"sha256,omitempty"`
+	// ErrorCode is the TFTP error code sent to or received from the client
+	ErrorCode *uint16 `json:"error_code,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// AuditSink keeps the records of every transfer attempt
+type AuditSink interface {
+	Record(record *AuditRecord) error
+	Close() error
+}
+
+// AuditSinks hands every record to each of its sinks
+type AuditSinks []AuditSink
+
+func (sinks AuditSinks) Record(record *AuditRecord) error {
+	var err error
+	for _, sink := range sinks {
+		if sinkErr := sink.Record(record); sinkErr != nil && err == nil {
+			err = sinkErr
+		}
+	}
+	return err
+}
+
+func (sinks AuditSinks) Close() error {
+	var err error
+	for _, sink := range sinks {
+		if sinkErr := sink.Close(); sinkErr != nil && err == nil {
+			err = sinkErr
+		}
+	}
+	return err
+}
+
+// tftpError is an error packet sent or received over a connection
+type tftpError struct {
+	code     uint16
+	message  string
+	received bool
+}
+
+// operationName returns the direction of the transfer a request asks for
+func operationName(opCode uint16) string {
+	if opCode == WRQ {
+		return WriteDirection
+	}
+	return ReadDirection
+}
+
+// newAuditRecord starts the record of a request received now
+func newAuditRecord(operation string, reqInfo *RequestInfo) *AuditRecord {
+	record := &AuditRecord{
+		Time:      time.Now(),
+		Operation: operation,
+		Filename:  reqInfo.filename,
+	}
+	if reqInfo.remote != nil {
+		record.Client = reqInfo.remote.String()
+	}
+	return record
+}
+
+// record hands a record over to the audit sink of the request, if any
+func (r *RequestInfo) record(record *AuditRecord) {
+	if r.audit == nil {
+		return
+	}
+	record.Duration = time.Since(record.Time).Seconds()
+	if err := r.audit.Record(record); err != nil {
+		r.log().Errorf("Cannot record the transfer of %v: %v", record.Filename, err)
+	}
+}
+
+// auditRefusal records a request answered with an error
+// before any session was started for it
+func (r *RequestInfo) auditRefusal(opCode uint16, errCode uint8, msg string) {
+	record := newAuditRecord(operationName(opCode), r)
+	code := uint16(errCode)
+	record.Result = AuditRefused
+	record.ErrorCode = &code
+	record.Error = msg
+	r.record(record)
+}
+
+// auditSession records how a session over udpUtils ended, having
+// transferred bytes of a file, checksum only being called for the
+// SHA-256 of the file once the transfer succeeded, returning nil
+// leaves the SHA-256 out of the record
+func (r *RequestInfo) auditSession(record *AuditRecord, transfer *Transfer,
+	udpUtils *UDPUtils, bytes int64, checksum func() []byte, err error) {
+
+	if r.audit == nil {
+		return
+	}
+	if transfer != nil {
+		record.SessionID = transfer.ID
+	}
+	record.Bytes = bytes
+	var lastError *tftpError
+	if udpUtils != nil {
+		lastError = udpUtils.lastError.Load()
+	}
+	switch {
+	case lastError != nil && lastError.received:
+		record.Result = AuditAborted
+	case lastError != nil || err != nil:
+		record.Result = AuditFailure
+	default:
+		record.Result = AuditSuccess
+		if checksum != nil {
+			record.SHA256 = hex.EncodeToString(checksum())
+		}
+	}
+	if lastError != nil {
+		code := lastError.code
+		record.ErrorCode = &code
+		record.Error = lastError.message
+	}
+	if err != nil && record.Error == "" {
+		record.Error = err.Error()
+	}
+	r.record(record)
+}
+
+// FileAuditSink appends records to a file as JSON lines,
+// rotating it once it would grow past a number of bytes.
+// Rotated files are numbered from the newest, "audit.log.1",
+// to the oldest, and only so many of them are kept.
+type FileAuditSink struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mutex    *sync.Mutex
+}
+
+// NewFileAuditSink opens the file records are appended to, maxBytes
+// of zero never rotating it and maxFiles of zero keeping every file
+func NewFileAuditSink(path string, maxBytes int64, maxFiles int) (*FileAuditSink, error) {
+	sink := &FileAuditSink{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		mutex:    &sync.Mutex{},
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (fs *FileAuditSink) open() error {
+	file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.file = file
+	fs.size = info.Size()
+	return nil
+}
+
+// Record appends a record and flushes it to disk
+func (fs *FileAuditSink) Record(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	if fs.file == nil {
+		return fmt.Errorf("Audit file %v is closed", fs.path)
+	}
+	if fs.maxBytes > 0 && fs.size > 0 && fs.size+int64(len(line)) > fs.maxBytes {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+// rotate starts a new file, the current one becoming the first
+// rotated file. The file is opened again even when rotating fails,
+// so records keep being appended somewhere.
+func (fs *FileAuditSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+	fs.file = nil
+
+	err := fs.shift()
+	if openErr := fs.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// shift renames every rotated file to the next number,
+// dropping the oldest, and the file to the first number
+func (fs *FileAuditSink) shift() error {
+	last := fs.maxFiles
+	if last == 0 {
+		for last = 1; fileExists(fs.rotatedPath(last)); last++ {
+		}
+	} else if err := os.Remove(fs.rotatedPath(last)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := last - 1; i >= 1; i-- {
+		err := os.Rename(fs.rotatedPath(i), fs.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(fs.path, fs.rotatedPath(1))
+}
+
+func (fs *FileAuditSink) rotatedPath(i int) string {
+	return fs.path + "." + strconv.Itoa(i)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (fs *FileAuditSink) Close() error {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
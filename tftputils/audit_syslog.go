@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package tftputils
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogAuditSink sends records to syslog as JSON, under the daemon
+// facility, successful transfers at the info severity and others
+// at the warning one
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink connects to the syslog server at address over
+// network, such as "udp", or to the local syslog when both are empty
+func NewSyslogAuditSink(network string, address string, tag string) (*SyslogAuditSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (ss *SyslogAuditSink) Record(record *AuditRecord) error {
+	message, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if record.Result == AuditSuccess {
+		return ss.writer.Info(string(message))
+	}
+	return ss.writer.Warning(string(message))
+}
+
+func (ss *SyslogAuditSink) Close() error {
+	return ss.writer.Close()
+}
@@ -0,0 +1,21 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package tftputils
+
+import "errors"
+
+// SyslogAuditSink is not supported on this platform
+type SyslogAuditSink struct{}
+
+func NewSyslogAuditSink(network string, address string, tag string) (*SyslogAuditSink, error) {
+	return nil, errors.New("Syslog is not supported on this platform")
+}
+
+func (ss *SyslogAuditSink) Record(record *AuditRecord) error {
+	return errors.New("Syslog is not supported on this platform")
+}
+
+func (ss *SyslogAuditSink) Close() error {
+	return nil
+}
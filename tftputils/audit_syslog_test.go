@@ -0,0 +1,46 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package tftputils
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogAuditSink(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sink, err := NewSyslogAuditSink("udp", server.LocalAddr().String(), "simple_tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	code := uint16(FileNotFoundErr)
+	assert.Nil(t, sink.Record(&AuditRecord{Filename: "missing", Result: AuditFailure, ErrorCode: &code}))
+
+	buffer := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buffer[:n])
+	// Warning severity of the daemon facility, 3*8+4
+	assert.True(t, strings.HasPrefix(message, "<28>"), message)
+	assert.Contains(t, message, "simple_tftp")
+
+	record := AuditRecord{}
+	assert.Nil(t, json.Unmarshal([]byte(message[strings.Index(message, "{"):]), &record))
+	assert.Equal(t, "missing", record.Filename)
+	assert.Equal(t, uint16(FileNotFoundErr), *record.ErrorCode)
+}
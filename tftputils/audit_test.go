@@ -0,0 +1,199 @@
+package tftputils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryAuditSink keeps the records of a test server
+type memoryAuditSink struct {
+	records []AuditRecord
+	closed  bool
+	mutex   sync.Mutex
+}
+
+func (ms *memoryAuditSink) Record(record *AuditRecord) error {
+	defer ms.mutex.Unlock()
+	ms.mutex.Lock()
+	ms.records = append(ms.records, *record)
+	return nil
+}
+
+func (ms *memoryAuditSink) Close() error {
+	defer ms.mutex.Unlock()
+	ms.mutex.Lock()
+	ms.closed = true
+	return nil
+}
+
+// waitFor returns the first record of a file once it is recorded
+func (ms *memoryAuditSink) waitFor(filename string) *AuditRecord {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		ms.mutex.Lock()
+		for _, record := range ms.records {
+			if record.Filename == filename {
+				ms.mutex.Unlock()
+				return &record
+			}
+		}
+		ms.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func readAuditFile(t *testing.T, path string) []AuditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewFileAuditSink(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each record takes more than half of the file
+	for _, filename := range []string{"a", "b", "c", "d", "e"} {
+		assert.Nil(t, sink.Record(&AuditRecord{Filename: filename, Result: AuditSuccess}))
+	}
+	assert.Nil(t, sink.Close())
+	assert.NotNil(t, sink.Record(&AuditRecord{Filename: "f"}))
+
+	for path, filename := range map[string]string{path: "e", path + ".1": "d", path + ".2": "c"} {
+		records := readAuditFile(t, path)
+		if assert.Len(t, records, 1, path) {
+			assert.Equal(t, filename, records[0].Filename)
+		}
+	}
+	assert.False(t, fileExists(path+".3"))
+
+	// Records are appended to the existing file, rotated files
+	// are all kept without a limit
+	sink, err = NewFileAuditSink(path, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, sink.Record(&AuditRecord{Filename: "f"}))
+	assert.Nil(t, sink.Close())
+	assert.Equal(t, "c", readAuditFile(t, path+".3")[0].Filename)
+	assert.Equal(t, "f", readAuditFile(t, path)[0].Filename)
+}
+
+func TestAuditSinks(t *testing.T) {
+	first, second := &memoryAuditSink{}, &memoryAuditSink{}
+	sinks := AuditSinks{first, second}
+	assert.Nil(t, sinks.Record(&AuditRecord{Filename: "boot/pxelinux.0"}))
+	assert.Nil(t, sinks.Close())
+	assert.Len(t, first.records, 1)
+	assert.Len(t, second.records, 1)
+	assert.True(t, first.closed && second.closed)
+}
+
+func TestAuditTransfers(t *testing.T) {
+	sink := &memoryAuditSink{}
+	config := NewServerConfig()
+	config.Audit = sink
+	assert.Nil(t, config.ReadACL.Set("deny 127.0.0.1 secrets/"))
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	data := []byte("boot")
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", data)))
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, _, err := upstream.Fetch("boot/pxelinux.0")
+	if assert.Nil(t, err) {
+		ioutil.ReadAll(body)
+		body.Close()
+	}
+	record := sink.waitFor("boot/pxelinux.0")
+	if assert.NotNil(t, record) {
+		digest := sha256.Sum256(data)
+		assert.Equal(t, AuditSuccess, record.Result)
+		assert.Equal(t, ReadDirection, record.Operation)
+		assert.Equal(t, int64(len(data)), record.Bytes)
+		assert.Equal(t, hex.EncodeToString(digest[:]), record.SHA256)
+		assert.Equal(t, uint64(1), record.SessionID)
+		assert.Contains(t, record.Client, "127.0.0.1:")
+		assert.Nil(t, record.ErrorCode)
+	}
+
+	_, _, err = upstream.Fetch("missing")
+	assert.NotNil(t, err)
+	record = sink.waitFor("missing")
+	if assert.NotNil(t, record) && assert.NotNil(t, record.ErrorCode) {
+		assert.Equal(t, AuditFailure, record.Result)
+		assert.Equal(t, uint16(FileNotFoundErr), *record.ErrorCode)
+		assert.Empty(t, record.SHA256)
+	}
+
+	_, _, err = upstream.Fetch("secrets/key")
+	assert.NotNil(t, err)
+	record = sink.waitFor("secrets/key")
+	if assert.NotNil(t, record) && assert.NotNil(t, record.ErrorCode) {
+		assert.Equal(t, AuditRefused, record.Result)
+		assert.Equal(t, uint16(AccessViolationErr), *record.ErrorCode)
+		assert.Equal(t, uint64(0), record.SessionID)
+	}
+
+	assert.Nil(t, server.Shutdown())
+	assert.True(t, sink.closed)
+}
+
+func TestAuditLeavesOutUnknownDigests(t *testing.T) {
+	root, cleanup := tempRoot(t, map[string]string{"boot/pxelinux.0": "boot"})
+	defer cleanup()
+	sink := &memoryAuditSink{}
+	config := NewServerConfig()
+	config.Audit = sink
+	config.Roots = []string{root}
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+
+	// Files under a root have no recorded digest to audit
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, _, err := upstream.Fetch("boot/pxelinux.0")
+	if assert.Nil(t, err) {
+		ioutil.ReadAll(body)
+		body.Close()
+	}
+	record := sink.waitFor("boot/pxelinux.0")
+	if assert.NotNil(t, record) {
+		assert.Equal(t, AuditSuccess, record.Result)
+		assert.Equal(t, int64(4), record.Bytes)
+		assert.Empty(t, record.SHA256)
+	}
+}
@@ -0,0 +1,224 @@
+package tftputils
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn reads and writes several datagrams per system call
+// (recvmmsg / sendmmsg), it is implemented by the packet
+// connections of both families in golang.org/x/net.
+// UDP GSO is left out: it only coalesces datagrams to the same
+// client, which never has more than one block in flight.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(udp *UDPUtils) batchConn {
+	if isIPv4Socket(udp.connection.LocalAddr().(*net.UDPAddr)) {
+		return ipv4.NewPacketConn(udp.connection)
+	}
+	return ipv6.NewPacketConn(udp.connection)
+}
+
+// batchReader receives the datagrams of a listening connection
+// in batches, into buffers of the packet pool
+type batchReader struct {
+	udpUtils *UDPUtils
+	conn     batchConn
+	messages []ipv4.Message
+	buffers  []*[]byte
+	packets  []*Packet
+}
+
+func newBatchReader(udp *UDPUtils, size int) *batchReader {
+	reader := &batchReader{
+		udpUtils: udp,
+		conn:     newBatchConn(udp),
+		messages: make([]ipv4.Message, size),
+		buffers:  make([]*[]byte, size),
+		packets:  make([]*Packet, 0, size),
+	}
+	for i := range reader.messages {
+		reader.messages[i].Buffers = [][]byte{nil}
+		if udp.family != 0 {
+			reader.messages[i].OOB = make([]byte, oobSize)
+		}
+	}
+	return reader
+}
+
+// readPackets waits for at least one datagram and returns every
+// datagram already received, up to the size of the batch.
+// The slice returned is reused by the next call.
+func (r *batchReader) readPackets() ([]*Packet, error) {
+	for i := range r.messages {
+		if r.buffers[i] == nil {
+			r.buffers[i] = getPacketBuffer()
+		}
+		r.messages[i].Buffers[0] = *r.buffers[i]
+		if r.messages[i].OOB != nil {
+			r.messages[i].OOB = r.messages[i].OOB[:oobSize]
+		}
+	}
+
+	n, err := r.conn.ReadBatch(r.messages, 0)
+	if err != nil {
+		r.udpUtils.logger.Errorf("Cannot read from UDP: %v", err)
+		return nil, err
+	}
+
+	r.packets = r.packets[:0]
+	for i := 0; i < n; i++ {
+		message := &r.messages[i]
+		buf := r.buffers[i]
+		r.buffers[i] = nil
+
+		addr, ok := message.Addr.(*net.UDPAddr)
+		if !ok {
+			putPacketBuffer(buf)
+			continue
+		}
+		*buf = (*buf)[:message.N]
+		packet := &Packet{Data: *buf, Remote: addr, buf: buf}
+		r.udpUtils.parsePacketInfo(packet, message.OOB[:message.NN])
+		r.packets = append(r.packets, packet)
+	}
+	return r.packets, nil
+}
+
+// batchWrite is a datagram waiting for the batch writer
+type batchWrite struct {
+	data []byte
+	oob  []byte
+	addr *net.UDPAddr
+	done chan error
+}
+
+// batchWritePool recycles batch writes along with their done channel,
+// which is always drained before a write goes back to the pool
+var batchWritePool = sync.Pool{
+	New: func() interface{} {
+		return &batchWrite{done: make(chan error, 1)}
+	},
+}
+
+var errBatchWriterClosed = errors.New("Cannot write to UDP: connection closed")
+
+// batchWriter sends the datagrams of every session multiplexed on
+// a listening connection. Datagrams queued while a batch is being sent
+// go out together in the next one, so batches only grow under load
+// and a lone session doesn't wait on a timer.
+type batchWriter struct {
+	conn     batchConn
+	queue    chan *batchWrite
+	stopped  bool
+	mutex    *sync.Mutex
+	messages []ipv4.Message
+	pending  []*batchWrite
+}
+
+func newBatchWriter(udp *UDPUtils, size int) *batchWriter {
+	writer := &batchWriter{
+		conn:     newBatchConn(udp),
+		queue:    make(chan *batchWrite, size),
+		mutex:    &sync.Mutex{},
+		messages: make([]ipv4.Message, size),
+		pending:  make([]*batchWrite, 0, size),
+	}
+	for i := range writer.messages {
+		writer.messages[i].Buffers = [][]byte{nil}
+	}
+	go writer.run()
+	return writer
+}
+
+// write queues a datagram to addr and waits until it is sent
+func (w *batchWriter) write(data []byte, oob []byte, addr *net.UDPAddr) error {
+	pending := batchWritePool.Get().(*batchWrite)
+	pending.data, pending.oob, pending.addr = data, oob, addr
+
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		batchWritePool.Put(pending)
+		return errBatchWriterClosed
+	}
+	w.queue <- pending
+	w.mutex.Unlock()
+
+	// Every queued datagram gets an answer, even once stopped
+	err := <-pending.done
+	pending.data, pending.oob, pending.addr = nil, nil, nil
+	batchWritePool.Put(pending)
+	return err
+}
+
+// stop lets the writer send what is queued and exit
+func (w *batchWriter) stop() {
+	defer w.mutex.Unlock()
+	w.mutex.Lock()
+
+	if !w.stopped {
+		w.stopped = true
+		close(w.queue)
+	}
+}
+
+func (w *batchWriter) run() {
+	for pending := range w.queue {
+		w.pending = append(w.pending[:0], pending)
+
+	collect:
+		for len(w.pending) < len(w.messages) {
+			select {
+			case pending, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				w.pending = append(w.pending, pending)
+			default:
+				break collect
+			}
+		}
+		w.flush()
+	}
+}
+
+// flush sends the pending datagrams, a batch may be
+// sent partially so it loops until every one is sent
+func (w *batchWriter) flush() {
+	for i, pending := range w.pending {
+		message := &w.messages[i]
+		message.Buffers[0] = pending.data
+		message.OOB = pending.oob
+		message.Addr = pending.addr
+	}
+
+	sent := 0
+	for sent < len(w.pending) {
+		n, err := w.conn.WriteBatch(w.messages[sent:len(w.pending)], 0)
+		if err != nil {
+			// Fail the first datagram so one bad address
+			// doesn't take the rest of the batch down with it
+			w.pending[sent].done <- err
+			sent++
+			continue
+		}
+		for _, pending := range w.pending[sent : sent+n] {
+			pending.done <- nil
+		}
+		sent += n
+	}
+
+	for i := range w.pending {
+		w.messages[i].Buffers[0] = nil
+		w.messages[i].Addr = nil
+		w.pending[i] = nil
+	}
+}
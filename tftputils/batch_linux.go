@@ -0,0 +1,5 @@
+package tftputils
+
+// batchSupported tells whether batched reads and writes save system calls,
+// elsewhere golang.org/x/net sends one datagram per call anyway
+const batchSupported = true
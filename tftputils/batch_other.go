@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package tftputils
+
+// batchSupported tells whether batched reads and writes save system calls,
+// elsewhere golang.org/x/net sends one datagram per call anyway
+const batchSupported = false
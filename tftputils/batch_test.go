@@ -0,0 +1,185 @@
+package tftputils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchReaderReadsSeveralPackets(t *testing.T) {
+	if !batchSupported {
+		t.Skip("batched reads are Linux only")
+	}
+	listener, err := NewListener("127.0.0.1:0", false, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.udpUtils.CloseConnection()
+
+	client, err := NewUDPUtils("", listener.udpUtils.LocalAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+
+	messages := []string{"one", "two", "three"}
+	for _, message := range messages {
+		assert.Nil(t, client.WriteToConn([]byte(message)))
+	}
+
+	var received []string
+	for len(received) < len(messages) {
+		packets, err := listener.readPackets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range packets {
+			received = append(received, string(packet.Data))
+			assert.Equal(t, client.LocalAddress(), packet.Remote.String())
+			if assert.NotNil(t, packet.Local) {
+				assert.True(t, packet.Local.IP.Equal(net.ParseIP("127.0.0.1")))
+			}
+			packet.release()
+		}
+	}
+	assert.Equal(t, messages, received)
+}
+
+func TestBatchWriterSendsToEverySession(t *testing.T) {
+	if !batchSupported {
+		t.Skip("batched writes are Linux only")
+	}
+	listener, err := NewListener("127.0.0.1:0", true, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.udpUtils.CloseConnection()
+
+	var clients []*UDPUtils
+	for i := 0; i < 3; i++ {
+		client, err := NewUDPUtils("", listener.udpUtils.LocalAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.CloseConnection()
+		clients = append(clients, client)
+
+		remote := client.connection.LocalAddr().(*net.UDPAddr)
+		session, err := listener.mux.Open(&Packet{Remote: remote})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.CloseConnection()
+		go sendAckPacket(uint16(i), session)
+	}
+
+	for i, client := range clients {
+		data, _, err := client.ReadFromConn()
+		assert.Nil(t, err)
+		assert.Equal(t, createAckPacket(uint16(i)), data)
+	}
+
+	listener.udpUtils.CloseConnection()
+	assert.Equal(t, errBatchWriterClosed, listener.udpUtils.batch.write([]byte{0}, nil, clients[0].remoteAddr))
+}
+
+func benchmarkListenerRead(b *testing.B, batchSize int) {
+	listener, err := NewListener("127.0.0.1:0", false, batchSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.udpUtils.CloseConnection()
+	client, err := NewUDPUtils("", listener.udpUtils.LocalAddress())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.CloseConnection()
+
+	// Send in rounds small enough for the socket buffer,
+	// so no datagram gets dropped while the listener catches up
+	const round = 64
+	block := createDataPacket(1, make([]byte, SmallestBlockSize))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += round {
+		n := round
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		for i := 0; i < n; i++ {
+			if err := client.WriteToConn(block); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for received := 0; received < n; {
+			packets, err := listener.readPackets()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, packet := range packets {
+				packet.release()
+			}
+			received += len(packets)
+		}
+	}
+}
+
+func BenchmarkListenerRead(b *testing.B) {
+	benchmarkListenerRead(b, 0)
+}
+
+func BenchmarkListenerReadBatch(b *testing.B) {
+	if !batchSupported {
+		b.Skip("batched reads are Linux only")
+	}
+	benchmarkListenerRead(b, 32)
+}
+
+// benchmarkMultiplexedWrite sends blocks from many sessions
+// sharing the listening socket, as in single port mode
+func benchmarkMultiplexedWrite(b *testing.B, batchSize int) {
+	listener, err := NewListener("127.0.0.1:0", true, batchSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.udpUtils.CloseConnection()
+
+	b.ReportAllocs()
+	b.SetBytes(SmallestBlockSize + 4)
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Nobody reads the client, the kernel drops what overflows its buffer
+		client, err := NewUDPUtils("127.0.0.1:0", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.CloseConnection()
+		remote := client.connection.LocalAddr().(*net.UDPAddr)
+		session, err := listener.mux.Open(&Packet{Remote: remote})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer session.CloseConnection()
+
+		block := make([]byte, SmallestBlockSize)
+		for i := 0; pb.Next(); i++ {
+			if err := sendDataPacket(uint16(i), block, session); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMultiplexedWrite(b *testing.B) {
+	benchmarkMultiplexedWrite(b, 0)
+}
+
+func BenchmarkMultiplexedWriteBatch(b *testing.B) {
+	if !batchSupported {
+		b.Skip("batched writes are Linux only")
+	}
+	benchmarkMultiplexedWrite(b, 32)
+}
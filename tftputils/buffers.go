@@ -0,0 +1,31 @@
+package tftputils
+
+import "sync"
+
+// maxPacketSize bounds the packets read from the network,
+// a data packet of the largest block plus its header fits
+const maxPacketSize = 1024
+
+// packetPool recycles packet buffers across sessions, so a boot storm
+// of short transfers doesn't leave a buffer per packet to the garbage collector.
+// It holds pointers to slices so putting them back doesn't allocate.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxPacketSize)
+		return &buf
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+// putPacketBuffer hands a buffer back to the pool, buffers that
+// didn't come from it are left to the garbage collector
+func putPacketBuffer(buf *[]byte) {
+	if buf == nil || cap(*buf) < maxPacketSize {
+		return
+	}
+	*buf = (*buf)[:maxPacketSize]
+	packetPool.Put(buf)
+}
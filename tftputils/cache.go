@@ -0,0 +1,185 @@
+package tftputils
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// CacheStats counts how the files read through a cache were served
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// CachingStorage keeps the most recently read files of a slower storage
+// in memory, up to a byte budget, evicting the least recently read first.
+// Files are dropped from the cache when they are written or deleted,
+// files larger than the whole budget are never cached.
+// A file missed is read into the cache in the background.
+type CachingStorage struct {
+	Storage
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	// filling holds the files being read into the cache
+	filling map[string]struct{}
+	// generation changes on every write, a file read from the storage
+	// while it changed may be stale and is not cached
+	generation uint64
+	stats      CacheStats
+	mutex      *sync.Mutex
+}
+
+func NewCachingStorage(storage Storage, maxBytes int64) *CachingStorage {
+	return &CachingStorage{
+		Storage:  storage,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		filling:  make(map[string]struct{}),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (cs *CachingStorage) Put(file *FileObject) error {
+	defer cs.invalidate(file.filename)
+	return cs.Storage.Put(file)
+}
+
+func (cs *CachingStorage) Replace(file *FileObject) error {
+	defer cs.invalidate(file.filename)
+	return cs.Storage.Replace(file)
+}
+
+func (cs *CachingStorage) Delete(filename string) error {
+	defer cs.invalidate(filename)
+	return cs.Storage.Delete(filename)
+}
+
+// Get returns a file from the cache. On a miss the file is served
+// straight from the storage while a copy is read into the cache in
+// the background, so the first reader doesn't wait for the whole file.
+func (cs *CachingStorage) Get(filename string) (*FileObject, error) {
+	cs.mutex.Lock()
+	if element, ok := cs.entries[filename]; ok {
+		cs.lru.MoveToFront(element)
+		cs.stats.Hits++
+		cs.mutex.Unlock()
+		return element.Value.(*FileObject), nil
+	}
+	cs.stats.Misses++
+	generation := cs.generation
+	_, filling := cs.filling[filename]
+	if !filling {
+		cs.filling[filename] = struct{}{}
+	}
+	cs.mutex.Unlock()
+
+	file, err := cs.Storage.Get(filename)
+	if filling {
+		return file, err
+	}
+	if err != nil || file.Size() > cs.maxBytes {
+		cs.doneFilling(filename)
+		return file, err
+	}
+	go cs.fill(filename, generation)
+	return file, nil
+}
+
+// fill reads a file missed into the cache, unless
+// the storage changed since the miss
+func (cs *CachingStorage) fill(filename string, generation uint64) {
+	defer cs.doneFilling(filename)
+	file, err := cs.Storage.Get(filename)
+	if err != nil {
+		return
+	}
+	cached, err := cacheFile(file)
+	if err != nil {
+		return
+	}
+
+	defer cs.mutex.Unlock()
+	cs.mutex.Lock()
+	if _, ok := cs.entries[filename]; ok || generation != cs.generation {
+		return
+	}
+	cs.entries[filename] = cs.lru.PushFront(cached)
+	cs.bytes += cached.Size()
+	for cs.bytes > cs.maxBytes {
+		cs.evict(cs.lru.Back())
+		cs.stats.Evictions++
+	}
+}
+
+// doneFilling lets the next miss of a file read it into the cache
+func (cs *CachingStorage) doneFilling(filename string) {
+	defer cs.mutex.Unlock()
+	cs.mutex.Lock()
+	delete(cs.filling, filename)
+}
+
+// cacheFile reads the content of a file into memory,
+// keeping its checksums and metadata
+func cacheFile(file *FileObject) (*FileObject, error) {
+	defer file.Close()
+	data := make([]byte, file.Size())
+	if _, err := io.ReadFull(file.NewReader(), data); err != nil {
+		return nil, err
+	}
+	cached := NewFileObject(file.filename, data)
+	cached.setChecksums(file.SHA256(), file.CRC32())
+	cached.SetMetadata(file.Metadata())
+	return cached, nil
+}
+
+// ReserveRead and ReleaseRead pass reads in progress on to the cached storage
+func (cs *CachingStorage) ReserveRead(filename string) error {
+	return reserveRead(cs.Storage, filename)
+}
+
+func (cs *CachingStorage) ReleaseRead(filename string) {
+	releaseRead(cs.Storage, filename)
+}
+
+// RecordRead passes completed reads on to the cached storage
+func (cs *CachingStorage) RecordRead(filename string) {
+	recordRead(cs.Storage, filename)
+}
+
+// Stats returns the hit and miss counts and the size of the cache
+func (cs *CachingStorage) Stats() CacheStats {
+	defer cs.mutex.Unlock()
+	cs.mutex.Lock()
+
+	stats := cs.stats
+	stats.Files = cs.lru.Len()
+	stats.Bytes = cs.bytes
+	stats.MaxBytes = cs.maxBytes
+	return stats
+}
+
+// invalidate drops a file that was written or deleted from the cache
+func (cs *CachingStorage) invalidate(filename string) {
+	defer cs.mutex.Unlock()
+	cs.mutex.Lock()
+
+	cs.generation++
+	if element, ok := cs.entries[filename]; ok {
+		cs.evict(element)
+	}
+}
+
+// evict drops a cached file, the caller must hold the mutex
+func (cs *CachingStorage) evict(element *list.Element) {
+	file := cs.lru.Remove(element).(*FileObject)
+	delete(cs.entries, file.filename)
+	cs.bytes -= file.Size()
+}
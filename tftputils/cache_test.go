@@ -0,0 +1,163 @@
+package tftputils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the files read from a storage
+type countingStorage struct {
+	Storage
+	gets int
+}
+
+func (c *countingStorage) Get(filename string) (*FileObject, error) {
+	c.gets++
+	return c.Storage.Get(filename)
+}
+
+// gatedReader blocks reads until it is released
+type gatedReader struct {
+	data    []byte
+	release chan struct{}
+}
+
+func (g *gatedReader) ReadAt(p []byte, off int64) (int, error) {
+	<-g.release
+	return bytes.NewReader(g.data).ReadAt(p, off)
+}
+
+// gatedStorage serves files whose content isn't readable until released
+type gatedStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (g *gatedStorage) Get(filename string) (*FileObject, error) {
+	file, err := g.Storage.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := ioutil.ReadAll(file.NewReader())
+	gated := &gatedReader{data: content, release: g.release}
+	return NewFileObjectReaderAt(filename, gated, file.Size()), nil
+}
+
+// cacheGet reads a file through the cache and waits
+// for a miss to be read into the cache
+func cacheGet(t *testing.T, cache *CachingStorage, filename string) (*FileObject, error) {
+	file, err := cache.Get(filename)
+	assert.Eventually(t, func() bool {
+		defer cache.mutex.Unlock()
+		cache.mutex.Lock()
+		return len(cache.filling) == 0
+	}, time.Second, time.Millisecond)
+	return file, err
+}
+
+func TestCachingStorageHits(t *testing.T) {
+	backend := &countingStorage{Storage: NewFileStore()}
+	assert.Nil(t, backend.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+	cache := NewCachingStorage(backend, 1024)
+
+	for i := 0; i < 3; i++ {
+		file, err := cacheGet(t, cache, "boot/pxelinux.0")
+		assert.Nil(t, err)
+		assert.Nil(t, file.Verify())
+		assert.False(t, file.Metadata().Created.IsZero())
+	}
+	// The miss is served from the storage and read again into the cache
+	assert.Equal(t, 2, backend.gets)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Files: 1, Bytes: 4, MaxBytes: 1024}, cache.Stats())
+
+	_, err := cacheGet(t, cache, "missing")
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), cache.Stats().Evictions)
+}
+
+func TestCachingStorageInvalidates(t *testing.T) {
+	cache := NewCachingStorage(NewFileStore(), 1024)
+	assert.Nil(t, cache.Put(NewFileObject("hello.txt", []byte("hello"))))
+	_, err := cacheGet(t, cache, "hello.txt")
+	assert.Nil(t, err)
+
+	assert.Nil(t, cache.Replace(NewFileObject("hello.txt", []byte("bye"))))
+	file, err := cacheGet(t, cache, "hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), file.Size())
+
+	assert.Nil(t, cache.Delete("hello.txt"))
+	_, err = cacheGet(t, cache, "hello.txt")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, cache.Stats().Files)
+}
+
+func TestCachingStorageEvictsLeastRecentlyRead(t *testing.T) {
+	backend := &countingStorage{Storage: NewFileStore()}
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Nil(t, backend.Put(NewFileObject(name, []byte("0123456789"))))
+	}
+	assert.Nil(t, backend.Put(NewFileObject("big", make([]byte, 100))))
+	cache := NewCachingStorage(backend, 25)
+
+	cacheGet(t, cache, "a")
+	cacheGet(t, cache, "b")
+	cacheGet(t, cache, "a")
+	cacheGet(t, cache, "c")
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, int64(20), stats.Bytes)
+
+	backend.gets = 0
+	cacheGet(t, cache, "a")
+	cacheGet(t, cache, "c")
+	assert.Equal(t, 0, backend.gets)
+	cacheGet(t, cache, "b")
+	assert.Equal(t, 2, backend.gets)
+
+	// Files over the whole budget are read straight through
+	file, err := cacheGet(t, cache, "big")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), file.Size())
+	assert.Equal(t, 2, cache.Stats().Files)
+}
+
+func TestCachingStorageStreamsMisses(t *testing.T) {
+	backend := &gatedStorage{Storage: NewFileStore(), release: make(chan struct{})}
+	assert.Nil(t, backend.Put(NewFileObject("boot.img", []byte("boot"))))
+	cache := NewCachingStorage(backend, 1024)
+
+	// The miss returns before any of the content is read
+	file, err := cache.Get("boot.img")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), file.Size())
+	assert.Equal(t, 0, cache.Stats().Files)
+
+	close(backend.release)
+	content, err := ioutil.ReadAll(file.NewReader())
+	assert.Nil(t, err)
+	assert.Equal(t, "boot", string(content))
+	assert.Eventually(t, func() bool {
+		return cache.Stats().Files == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestAdminCache(t *testing.T) {
+	cache := NewCachingStorage(NewFileStore(), 1024)
+	handler := NewAdminHandler(cache, NewTransferRegistry())
+	response := adminRequest(handler, http.MethodGet, "/cache", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	handler.cache = cache
+	response = adminRequest(handler, http.MethodGet, "/cache", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var stats CacheStats
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &stats))
+	assert.Equal(t, int64(1024), stats.MaxBytes)
+}
@@ -0,0 +1,163 @@
+package tftputils
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// ServerConfig holds the settings of a serve session
+type ServerConfig struct {
+	// Addresses to listen on, a random localhost port when empty.
+	// Requests are answered from the address they were sent to.
+	Addresses AddressList
+	// ReadACL and WriteACL restrict which clients may
+	// read and write files, nil allows everyone
+	ReadACL  *ACL
+	WriteACL *ACL
+	// Permissions restricts which operations are allowed
+	// on which files, nil allows everything
+	Permissions *Permissions
+
+	// MaxSessions and MaxClientSessions cap the number of
+	// concurrent transfers overall and per client ip
+	MaxSessions       int
+	MaxClientSessions int
+	// RequestRate and ClientRequestRate limit the requests
+	// per second overall and per client ip, with bursts of up to
+	// RequestBurst and ClientRequestBurst (default one second worth)
+	RequestRate        float64
+	RequestBurst       int
+	ClientRequestRate  float64
+	ClientRequestBurst int
+	// SessionBandwidth shapes every transfer to
+	// the given bytes per second
+	SessionBandwidth int
+	// Timeout is how long a transfer waits for the client before
+	// sending its last packet again, Retries how many times it does
+	// so before giving up on the client (default 5s and 5 times)
+	Timeout time.Duration
+	Retries int
+	// ShutdownTimeout is how long a shutdown waits for the
+	// running transfers before aborting them (default 10s)
+	ShutdownTimeout time.Duration
+
+	// Storage keeps the files, an in-memory FileStore when nil,
+	// or a DedupStore when Dedup is set
+	Storage Storage
+	Dedup   bool
+	// Roots are directories searched in order for the files read
+	// before Storage, which files are still written to
+	Roots PathList
+	// VerifyReads checks every file read against the checksums
+	// recorded when it was stored, refusing corrupted files
+	VerifyReads bool
+	// StoreLimits bounds the size of the file storage
+	StoreLimits StoreLimits
+	// Upstream is a "tftp://host[:port]" server or an HTTP URL,
+	// {filename} standing for the filename, that files missing
+	// from the storage are fetched from. UpstreamCache stores
+	// the files fetched, UpstreamTimeout bounds how long the
+	// upstream is waited for (default 5s).
+	Upstream        string
+	UpstreamCache   bool
+	UpstreamTimeout time.Duration
+	// CacheBytes keeps up to that many bytes of the most recently
+	// read files in memory, for storages slower than memory
+	CacheBytes int64
+	// Expiry gives stored files a time to live or a number of reads,
+	// expired files are deleted every ExpiryInterval (default a minute)
+	Expiry         *ExpiryRules
+	ExpiryInterval time.Duration
+	// Rewriter maps the filenames requested to the filenames served
+	Rewriter *Rewriter
+
+	// Audit records every transfer attempt when set,
+	// it is closed when the server shuts down
+	Audit AuditSink
+
+	// TraceDir receives a trace of every packet of the sessions with
+	// the clients TraceClients allows, every client when it has no
+	// rules, a file per session in TraceFormat, "pcap" or "text"
+	TraceDir     string
+	TraceFormat  string
+	TraceClients *ACL
+
+	// Logger is what the server logs through, the standard logrus
+	// logger when nil.
+	Logger Logger
+
+	// SnapshotPath keeps the file storage across restarts when set,
+	// it is saved every SnapshotInterval and on shutdown
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// AdminAddress serves the HTTP admin API when set,
+	// it has no authentication so keep it on a trusted network
+	AdminAddress string
+
+	// HTTPAddress serves the stored files over HTTP when set,
+	// to the clients allowed by HTTPACL
+	HTTPAddress string
+	HTTPACL     *ACL
+
+	// SinglePort runs every transfer over the listening socket
+	// instead of a new socket per transfer, for firewalls and
+	// container platforms that only expose the listening port
+	SinglePort bool
+	// TransferPorts restricts the ports transfers run on
+	// to a range such as "50000-50100", instead of any ephemeral port
+	TransferPorts string
+	// BatchSize receives up to that many datagrams per system call
+	// on Linux, and sends as many at once in single port mode.
+	// Zero or one reads and writes a datagram at a time.
+	BatchSize int
+}
+
+func NewServerConfig() *ServerConfig {
+	return &ServerConfig{
+		ReadACL:      NewACL(),
+		WriteACL:     NewACL(),
+		HTTPACL:      NewACL(),
+		TraceClients: NewACL(),
+
+		Permissions: NewPermissions(),
+		Expiry:      NewExpiryRules(),
+		Rewriter:    NewRewriter(),
+	}
+}
+
+// AddressList is a list of addresses usable as a repeatable flag
+type AddressList []string
+
+func (l *AddressList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+// Set adds an address, or several separated by commas
+func (l *AddressList) Set(value string) error {
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			*l = append(*l, address)
+		}
+	}
+	return nil
+}
+
+// PathList is a list of paths usable as a repeatable flag
+type PathList []string
+
+func (l *PathList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, string(os.PathListSeparator))
+}
+
+func (l *PathList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
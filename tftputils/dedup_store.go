@@ -0,0 +1,268 @@
+package tftputils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// blob is content stored once however many files share it
+type blob struct {
+	content io.ReaderAt
+	size    int64
+	crc32   uint32
+	refs    int
+}
+
+// dedupEntry is a filename of a DedupStore
+type dedupEntry struct {
+	digest   [sha256.Size]byte
+	metadata FileMetadata
+}
+
+// DedupStore is a content addressed storage, it keeps every distinct
+// content once by its SHA-256 and maps filenames to digests.
+// Limits on the total size count each distinct content once.
+type DedupStore struct {
+	blobs      map[[sha256.Size]byte]*blob
+	names      map[string]*dedupEntry
+	mutex      *sync.Mutex
+	limits     StoreLimits
+	totalBytes int64
+	version    uint64
+}
+
+func NewDedupStore() *DedupStore {
+	return &DedupStore{
+		blobs: make(map[[sha256.Size]byte]*blob),
+		names: make(map[string]*dedupEntry),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (ds *DedupStore) SetLimits(limits StoreLimits) {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	ds.limits = limits
+}
+
+func (ds *DedupStore) Put(file *FileObject) error {
+	// Hash before locking, it reads the whole content
+	file.prepare()
+	digest := file.SHA256()
+
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	if _, ok := ds.names[file.filename]; ok {
+		return fmt.Errorf("%v exists", file.filename)
+	}
+	if err := ds.checkQuota(file.size, !ds.isStored(digest)); err != nil {
+		return err
+	}
+	file.stamp(nil)
+	ds.link(file, digest)
+	ds.version++
+	return nil
+}
+
+func (ds *DedupStore) Replace(file *FileObject) error {
+	file.prepare()
+	digest := file.SHA256()
+
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	// Take the old file out so it doesn't count against the quota
+	old, exists := ds.names[file.filename]
+	var oldBlob *blob
+	var replaced *FileObject
+	if exists {
+		replaced = ds.fileObject(file.filename, old)
+		oldBlob = ds.unlink(file.filename)
+	}
+	if err := ds.checkQuota(file.size, !ds.isStored(digest)); err != nil {
+		if exists {
+			ds.relink(file.filename, old, oldBlob)
+		}
+		return err
+	}
+	file.stamp(replaced)
+	ds.link(file, digest)
+	ds.version++
+	return nil
+}
+
+func (ds *DedupStore) Delete(filename string) error {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	if _, ok := ds.names[filename]; !ok {
+		return fmt.Errorf("%v does not exist", filename)
+	}
+	ds.unlink(filename)
+	ds.version++
+	return nil
+}
+
+// link maps the filename of file to its content,
+// the caller must hold the mutex
+func (ds *DedupStore) link(file *FileObject, digest [sha256.Size]byte) {
+	stored, ok := ds.blobs[digest]
+	if !ok {
+		stored = &blob{content: file.content, size: file.size, crc32: file.CRC32()}
+		ds.blobs[digest] = stored
+		ds.totalBytes += stored.size
+	}
+	stored.refs++
+	ds.names[file.filename] = &dedupEntry{digest: digest, metadata: file.metadata}
+}
+
+// unlink removes a filename, dropping its content once no other
+// file refers to it. It returns the content the filename referred to.
+// The caller must hold the mutex.
+func (ds *DedupStore) unlink(filename string) *blob {
+	entry := ds.names[filename]
+	delete(ds.names, filename)
+	stored := ds.blobs[entry.digest]
+	stored.refs--
+	if stored.refs == 0 {
+		delete(ds.blobs, entry.digest)
+		ds.totalBytes -= stored.size
+	}
+	return stored
+}
+
+// relink undoes unlink, the caller must hold the mutex
+func (ds *DedupStore) relink(filename string, entry *dedupEntry, stored *blob) {
+	if stored.refs == 0 {
+		ds.blobs[entry.digest] = stored
+		ds.totalBytes += stored.size
+	}
+	stored.refs++
+	ds.names[filename] = entry
+}
+
+// CheckQuota determines whether a new file of the given size fits,
+// assuming its content isn't stored yet.
+func (ds *DedupStore) CheckQuota(size int64) error {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	return ds.checkQuota(size, true)
+}
+
+// checkQuota does the work of CheckQuota, content already stored
+// takes no space. The caller must hold the mutex.
+func (ds *DedupStore) checkQuota(size int64, newContent bool) error {
+	limits := ds.limits
+	if limits.MaxFileBytes > 0 && size > limits.MaxFileBytes {
+		return &QuotaError{fmt.Sprintf("File size %v exceeds the limit of %v bytes", size, limits.MaxFileBytes)}
+	}
+	if newContent && limits.MaxTotalBytes > 0 && ds.totalBytes+size > limits.MaxTotalBytes {
+		return &QuotaError{fmt.Sprintf("Storage is full, %v of %v bytes used", ds.totalBytes, limits.MaxTotalBytes)}
+	}
+	if limits.MaxFiles > 0 && len(ds.names) >= limits.MaxFiles {
+		return &QuotaError{fmt.Sprintf("Storage is full, %v files stored", len(ds.names))}
+	}
+	return nil
+}
+
+// isStored determines whether content is already stored,
+// the caller must hold the mutex
+func (ds *DedupStore) isStored(digest [sha256.Size]byte) bool {
+	_, ok := ds.blobs[digest]
+	return ok
+}
+
+func (ds *DedupStore) Get(filename string) (*FileObject, error) {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	entry, ok := ds.names[filename]
+	if !ok {
+		return nil, fmt.Errorf("%v does not exist", filename)
+	}
+	return ds.fileObject(filename, entry), nil
+}
+
+// fileObject creates the file for a filename, its digest is already
+// known. The caller must hold the mutex.
+func (ds *DedupStore) fileObject(filename string, entry *dedupEntry) *FileObject {
+	stored := ds.blobs[entry.digest]
+	file := NewFileObjectReaderAt(filename, stored.content, stored.size)
+	file.setChecksums(entry.digest, stored.crc32)
+	file.metadata = entry.metadata
+	return file
+}
+
+// Digest returns the SHA-256 of the content of a file
+func (ds *DedupStore) Digest(filename string) ([sha256.Size]byte, error) {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	entry, ok := ds.names[filename]
+	if !ok {
+		return [sha256.Size]byte{}, fmt.Errorf("%v does not exist", filename)
+	}
+	return entry.digest, nil
+}
+
+// Filenames returns the names of the files sharing the given content
+func (ds *DedupStore) Filenames(digest [sha256.Size]byte) []string {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	filenames := []string{}
+	for filename, entry := range ds.names {
+		if entry.digest == digest {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// Usage returns the bytes actually stored, and the bytes
+// the files would take without deduplication
+func (ds *DedupStore) Usage() (stored int64, logical int64) {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	for _, entry := range ds.names {
+		logical += ds.blobs[entry.digest].size
+	}
+	return ds.totalBytes, logical
+}
+
+func (ds *DedupStore) Files() []*FileObject {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	files := make([]*FileObject, 0, len(ds.names))
+	for filename, entry := range ds.names {
+		files = append(files, ds.fileObject(filename, entry))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].filename < files[j].filename
+	})
+	return files
+}
+
+func (ds *DedupStore) Version() uint64 {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	return ds.version
+}
+
+func (ds *DedupStore) DoesFileExist(filename string) bool {
+	defer ds.mutex.Unlock()
+	ds.mutex.Lock()
+
+	_, ok := ds.names[filename]
+	return ok
+}
@@ -0,0 +1,97 @@
+package tftputils
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupStoreSharesContent(t *testing.T) {
+	store := NewDedupStore()
+	data := []byte("same image")
+	assert.Nil(t, store.Put(NewFileObject("a.img", data)))
+	assert.Nil(t, store.Put(NewFileObject("b.img", data)))
+	assert.NotNil(t, store.Put(NewFileObject("b.img", data)))
+	assert.Nil(t, store.Put(NewFileObject("c.img", []byte("other"))))
+
+	stored, logical := store.Usage()
+	assert.Equal(t, int64(len(data)+5), stored)
+	assert.Equal(t, int64(2*len(data)+5), logical)
+
+	digest, err := store.Digest("a.img")
+	assert.Nil(t, err)
+	assert.Equal(t, sha256.Sum256(data), digest)
+	assert.Equal(t, []string{"a.img", "b.img"}, store.Filenames(digest))
+
+	file, err := store.Get("b.img")
+	assert.Nil(t, err)
+	assert.Equal(t, "b.img", file.filename)
+	assert.Equal(t, digest, file.SHA256())
+	assert.Len(t, store.Files(), 3)
+}
+
+func TestDedupStoreDeleteCountsReferences(t *testing.T) {
+	store := NewDedupStore()
+	data := []byte("shared")
+	assert.Nil(t, store.Put(NewFileObject("a", data)))
+	assert.Nil(t, store.Put(NewFileObject("b", data)))
+
+	assert.Nil(t, store.Delete("a"))
+	stored, _ := store.Usage()
+	assert.Equal(t, int64(len(data)), stored)
+	assert.True(t, store.DoesFileExist("b"))
+
+	assert.Nil(t, store.Delete("b"))
+	stored, _ = store.Usage()
+	assert.Equal(t, int64(0), stored)
+	assert.NotNil(t, store.Delete("b"))
+	_, err := store.Digest("b")
+	assert.NotNil(t, err)
+}
+
+func TestDedupStoreQuota(t *testing.T) {
+	store := NewDedupStore()
+	store.SetLimits(StoreLimits{MaxTotalBytes: 4})
+	assert.Nil(t, store.Put(NewFileObject("a", []byte("abcd"))))
+	// Content already stored takes no space
+	assert.Nil(t, store.Put(NewFileObject("b", []byte("abcd"))))
+	assert.True(t, IsQuotaError(store.Put(NewFileObject("c", []byte("e")))))
+	assert.True(t, IsQuotaError(store.CheckQuota(1)))
+
+	// A failed replace leaves the old content in place
+	assert.True(t, IsQuotaError(store.Replace(NewFileObject("a", []byte("abcdef")))))
+	digest, err := store.Digest("a")
+	assert.Nil(t, err)
+	assert.Equal(t, sha256.Sum256([]byte("abcd")), digest)
+
+	// Replacing the last file using some content frees its space
+	assert.Nil(t, store.Delete("b"))
+	version := store.Version()
+	assert.Nil(t, store.Replace(NewFileObject("a", []byte("wxyz"))))
+	assert.NotEqual(t, version, store.Version())
+}
+
+func TestDedupStoreMetadata(t *testing.T) {
+	store := NewDedupStore()
+	data := []byte("same image")
+	first := NewFileObject("a.img", data)
+	first.SetMetadata(FileMetadata{Uploader: "10.0.0.1"})
+	assert.Nil(t, store.Put(first))
+	assert.Nil(t, store.Put(NewFileObject("b.img", data)))
+
+	// Files sharing content keep their own metadata
+	file, err := store.Get("a.img")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", file.Metadata().Uploader)
+	file, err = store.Get("b.img")
+	assert.Nil(t, err)
+	assert.Empty(t, file.Metadata().Uploader)
+
+	created := first.Metadata().Created
+	assert.Nil(t, store.Replace(NewFileObject("a.img", []byte("other"))))
+	file, err = store.Get("a.img")
+	assert.Nil(t, err)
+	assert.Equal(t, created, file.Metadata().Created)
+	assert.Empty(t, file.Metadata().Uploader)
+}
@@ -0,0 +1,124 @@
+package tftputils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errReadOnlyStore is returned when writing to a DirStore
+var errReadOnlyStore = errors.New("Storage is read-only")
+
+// DirStore serves the files under a directory on disk, read-only.
+// Filenames are slash separated paths relative to the directory,
+// paths leading out of it are refused.
+type DirStore struct {
+	root string
+}
+
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root}
+}
+
+// path returns where a file is on disk
+func (ds *DirStore) path(filename string) (string, error) {
+	cleaned := path.Clean("/" + filename)
+	if cleaned == "/" || strings.Contains(filename, "\x00") {
+		return "", fmt.Errorf("%v does not exist", filename)
+	}
+	return filepath.Join(ds.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (ds *DirStore) Get(filename string) (*FileObject, error) {
+	filePath, err := ds.path(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := OpenFileObject(filename, filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	file.SetMetadata(FileMetadata{
+		Created:     info.ModTime(),
+		Modified:    info.ModTime(),
+		ContentType: detectContentType(file.content, file.size),
+	})
+	// Hold no file open until the content is read
+	file.Close()
+	return file, nil
+}
+
+func (ds *DirStore) DoesFileExist(filename string) bool {
+	filePath, err := ds.path(filename)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Files returns every regular file under the directory. It only stats
+// them, their content is opened when read and their content type is
+// left for Get to sniff.
+func (ds *DirStore) Files() []*FileObject {
+	files := []*FileObject{}
+	filepath.WalkDir(ds.root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		relative, err := filepath.Rel(ds.root, filePath)
+		if err != nil {
+			return nil
+		}
+		content := &diskFile{path: filePath, mutex: &sync.Mutex{}}
+		file := NewFileObjectReaderAt(filepath.ToSlash(relative), content, info.Size())
+		file.SetMetadata(FileMetadata{
+			Created:  info.ModTime(),
+			Modified: info.ModTime(),
+		})
+		files = append(files, file)
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].filename < files[j].filename
+	})
+	return files
+}
+
+func (ds *DirStore) Put(file *FileObject) error {
+	return errReadOnlyStore
+}
+
+func (ds *DirStore) Replace(file *FileObject) error {
+	return errReadOnlyStore
+}
+
+func (ds *DirStore) Delete(filename string) error {
+	return errReadOnlyStore
+}
+
+func (ds *DirStore) SetLimits(limits StoreLimits) {}
+
+func (ds *DirStore) CheckQuota(size int64) error {
+	return errReadOnlyStore
+}
+
+// Version is always zero, changes made to the directory
+// by other programs are not tracked
+func (ds *DirStore) Version() uint64 {
+	return 0
+}
@@ -0,0 +1,64 @@
+package tftputils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tempRoot creates a directory holding the files given by filename
+func tempRoot(t *testing.T, files map[string]string) (string, func()) {
+	root, err := ioutil.TempDir("", "simple_tftp_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, content := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, func() { os.RemoveAll(root) }
+}
+
+func TestDirStore(t *testing.T) {
+	root, cleanup := tempRoot(t, map[string]string{
+		"boot/pxelinux.0": "boot",
+		"hello.txt":       "hello",
+	})
+	defer cleanup()
+	store := NewDirStore(filepath.Join(root, "boot"))
+
+	assert.True(t, store.DoesFileExist("pxelinux.0"))
+	assert.True(t, store.DoesFileExist("/pxelinux.0"))
+	assert.False(t, store.DoesFileExist("../hello.txt"))
+	assert.False(t, store.DoesFileExist(""))
+	file, err := store.Get("pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), file.Size())
+	assert.False(t, file.Metadata().Modified.IsZero())
+	// Nothing is held open until the content is read
+	assert.Nil(t, file.content.(*diskFile).file)
+
+	store = NewDirStore(root)
+	files := store.Files()
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "boot/pxelinux.0", files[0].filename)
+		assert.Equal(t, "hello.txt", files[1].filename)
+		// Listing opens no file, reading does
+		content := files[1].content.(*diskFile)
+		assert.Nil(t, content.file)
+		assert.Equal(t, int64(5), files[1].Size())
+		assert.Nil(t, files[1].Verify())
+		assert.NotNil(t, content.file)
+		assert.Nil(t, files[1].Close())
+	}
+	assert.NotNil(t, store.Put(NewFileObject("new.txt", []byte("new"))))
+	assert.NotNil(t, store.Delete("hello.txt"))
+}
@@ -0,0 +1,379 @@
+package tftputils
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultExpiryInterval is how often expired files are deleted
+// when no interval is given
+const defaultExpiryInterval = time.Minute
+
+// ExpiryRule gives files matching a glob pattern a time to live and
+// a number of completed reads they are deleted after, zero for either
+// keeps them however old they get or however many times they are read
+type ExpiryRule struct {
+	pattern  string
+	ttl      time.Duration
+	maxReads int
+}
+
+// ParseExpiryRule parses a rule in the form of "pattern ttl [max-reads]"
+func ParseExpiryRule(rule string) (*ExpiryRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("Malformed expiry rule: %q", rule)
+	}
+	if _, err := path.Match(fields[0], ""); err != nil {
+		return nil, fmt.Errorf("Malformed path pattern %v: %v", fields[0], err)
+	}
+	ttl, err := time.ParseDuration(fields[1])
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("Malformed time to live: %v", fields[1])
+	}
+	maxReads := 0
+	if len(fields) == 3 {
+		maxReads, err = strconv.Atoi(fields[2])
+		if err != nil || maxReads < 0 {
+			return nil, fmt.Errorf("Malformed read count: %v", fields[2])
+		}
+	}
+	return &ExpiryRule{
+		pattern:  fields[0],
+		ttl:      ttl,
+		maxReads: maxReads,
+	}, nil
+}
+
+func (r *ExpiryRule) String() string {
+	if r.maxReads > 0 {
+		return fmt.Sprintf("%v %v %v", r.pattern, r.ttl, r.maxReads)
+	}
+	return fmt.Sprintf("%v %v", r.pattern, r.ttl)
+}
+
+// ExpiryRules decides when stored files expire, rules are
+// evaluated in order and the first match wins.
+// Files matching no rule are kept until deleted.
+type ExpiryRules struct {
+	rules []*ExpiryRule
+}
+
+func NewExpiryRules() *ExpiryRules {
+	return &ExpiryRules{
+		rules: []*ExpiryRule{},
+	}
+}
+
+// AddRule parses and appends an expiry rule to the end of the list
+func (e *ExpiryRules) AddRule(rule string) error {
+	parsed, err := ParseExpiryRule(rule)
+	if err != nil {
+		return err
+	}
+	e.rules = append(e.rules, parsed)
+	return nil
+}
+
+// apply sets the expiry of a file stored at now from the first
+// matching rule, unless the file already has its own
+func (e *ExpiryRules) apply(file *FileObject, now time.Time) {
+	if e == nil {
+		return
+	}
+	for _, rule := range e.rules {
+		if !matchesPath(rule.pattern, file.filename) {
+			continue
+		}
+		if file.metadata.Expires.IsZero() && rule.ttl > 0 {
+			file.metadata.Expires = now.Add(rule.ttl)
+		}
+		if file.metadata.MaxReads == 0 {
+			file.metadata.MaxReads = rule.maxReads
+		}
+		return
+	}
+}
+
+// String and Set let expiry rules be used as a repeatable command line flag
+func (e *ExpiryRules) String() string {
+	if e == nil {
+		return ""
+	}
+	rules := make([]string, len(e.rules))
+	for i, rule := range e.rules {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (e *ExpiryRules) Set(rule string) error {
+	return e.AddRule(rule)
+}
+
+// ReadRecorder is implemented by storages acting on files being
+// read to the end, storages wrapping others pass it on. A read is
+// reserved before a file is served, then recorded once the file was
+// read to the end or released otherwise.
+type ReadRecorder interface {
+	ReserveRead(filename string) error
+	ReleaseRead(filename string)
+	RecordRead(filename string)
+}
+
+// reserveRead tells the storage a file is about to be read,
+// an error means the file may not be read anymore
+func reserveRead(fileS Storage, filename string) error {
+	if recorder, ok := fileS.(ReadRecorder); ok {
+		return recorder.ReserveRead(filename)
+	}
+	return nil
+}
+
+// releaseRead tells the storage a reserved read ended
+// before the file was read to the end
+func releaseRead(fileS Storage, filename string) {
+	if recorder, ok := fileS.(ReadRecorder); ok {
+		recorder.ReleaseRead(filename)
+	}
+}
+
+// recordRead tells the storage a file was read to the end
+func recordRead(fileS Storage, filename string) {
+	if recorder, ok := fileS.(ReadRecorder); ok {
+		recorder.RecordRead(filename)
+	}
+}
+
+// ExpiringStorage deletes the files of a storage once they are past
+// their expiry time or were read as many times as they allow.
+// Expired files are hidden right away and deleted by a janitor
+// goroutine every interval. Read counts are kept in memory only,
+// reads in progress count against the maximum until they end.
+type ExpiringStorage struct {
+	Storage
+	rules    *ExpiryRules
+	interval time.Duration
+	reads    map[string]int
+	reserved map[string]int
+	logger   Logger
+	mutex    *sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewExpiringStorage(storage Storage, rules *ExpiryRules, interval time.Duration) *ExpiringStorage {
+	if interval <= 0 {
+		interval = defaultExpiryInterval
+	}
+	return &ExpiringStorage{
+		Storage:  storage,
+		rules:    rules,
+		interval: interval,
+		reads:    make(map[string]int),
+		reserved: make(map[string]int),
+		logger:   defaultLogger,
+		mutex:    &sync.Mutex{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Put stores a file with the expiry of its rule,
+// an expired file of the same name is deleted first
+func (es *ExpiringStorage) Put(file *FileObject) error {
+	file.prepare()
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	now := time.Now()
+	es.expire(file.filename, now)
+	es.rules.apply(file, now)
+	err := es.Storage.Put(file)
+	if err == nil {
+		delete(es.reads, file.filename)
+	}
+	return err
+}
+
+func (es *ExpiringStorage) Replace(file *FileObject) error {
+	file.prepare()
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	es.rules.apply(file, time.Now())
+	err := es.Storage.Replace(file)
+	if err == nil {
+		delete(es.reads, file.filename)
+	}
+	return err
+}
+
+func (es *ExpiringStorage) Delete(filename string) error {
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	delete(es.reads, filename)
+	return es.Storage.Delete(filename)
+}
+
+// Get returns a file unless it has expired
+func (es *ExpiringStorage) Get(filename string) (*FileObject, error) {
+	file, err := es.Storage.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	if file.Metadata().expired(time.Now()) {
+		return nil, fmt.Errorf("%v does not exist", filename)
+	}
+	return file, nil
+}
+
+func (es *ExpiringStorage) DoesFileExist(filename string) bool {
+	if !es.Storage.DoesFileExist(filename) {
+		return false
+	}
+	_, err := es.Get(filename)
+	return err == nil
+}
+
+// Files returns every stored file that hasn't expired
+func (es *ExpiringStorage) Files() []*FileObject {
+	now := time.Now()
+	files := []*FileObject{}
+	for _, file := range es.Storage.Files() {
+		if !file.Metadata().expired(now) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// ReserveRead takes one of the reads a file allows before it is
+// served, refusing it once completed and ongoing reads took them all
+func (es *ExpiringStorage) ReserveRead(filename string) error {
+	file, err := es.Storage.Get(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	maxReads := file.Metadata().MaxReads
+
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	if maxReads > 0 && es.reads[filename]+es.reserved[filename] >= maxReads {
+		return fmt.Errorf("All %v reads of %v are taken", maxReads, filename)
+	}
+	if err := reserveRead(es.Storage, filename); err != nil {
+		return err
+	}
+	if maxReads > 0 {
+		es.reserved[filename]++
+	}
+	return nil
+}
+
+// ReleaseRead gives back the read reserved by a read that failed
+func (es *ExpiringStorage) ReleaseRead(filename string) {
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	es.release(filename)
+	releaseRead(es.Storage, filename)
+}
+
+// release drops a reservation of a file, es.mutex must be held
+func (es *ExpiringStorage) release(filename string) {
+	if es.reserved[filename] > 1 {
+		es.reserved[filename]--
+	} else {
+		delete(es.reserved, filename)
+	}
+}
+
+// RecordRead counts a completed read of a file,
+// deleting the file once it reached its maximum reads
+func (es *ExpiringStorage) RecordRead(filename string) {
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	es.release(filename)
+	recordRead(es.Storage, filename)
+	if !es.Storage.DoesFileExist(filename) {
+		return
+	}
+	file, err := es.Storage.Get(filename)
+	if err != nil || file.Metadata().MaxReads <= 0 {
+		return
+	}
+	es.reads[filename]++
+	if es.reads[filename] < file.Metadata().MaxReads {
+		return
+	}
+	delete(es.reads, filename)
+	if err := es.Storage.Delete(filename); err == nil {
+		es.logger.Infof("Deleted %v after %v reads", filename, file.Metadata().MaxReads)
+	}
+}
+
+// Sweep deletes every expired file, returning how many were
+func (es *ExpiringStorage) Sweep() int {
+	defer es.mutex.Unlock()
+	es.mutex.Lock()
+
+	now := time.Now()
+	expired := 0
+	for _, file := range es.Storage.Files() {
+		if file.Metadata().expired(now) && es.expire(file.filename, now) {
+			expired++
+		}
+	}
+	return expired
+}
+
+// expire deletes a file if it has expired at now.
+// The caller must hold the mutex.
+func (es *ExpiringStorage) expire(filename string, now time.Time) bool {
+	if !es.Storage.DoesFileExist(filename) {
+		return false
+	}
+	file, err := es.Storage.Get(filename)
+	if err != nil || !file.Metadata().expired(now) {
+		return false
+	}
+	delete(es.reads, filename)
+	if err := es.Storage.Delete(filename); err != nil {
+		es.logger.Errorf("Cannot delete expired %v: %v", filename, err)
+		return false
+	}
+	es.logger.Infof("Expired %v", filename)
+	return true
+}
+
+// Start deletes expired files in a new goroutine every interval
+func (es *ExpiringStorage) Start() {
+	go func() {
+		defer close(es.done)
+		ticker := time.NewTicker(es.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				es.Sweep()
+			case <-es.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the janitor goroutine
+func (es *ExpiringStorage) Stop() {
+	close(es.stop)
+	<-es.done
+}
@@ -0,0 +1,125 @@
+package tftputils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpiryRule(t *testing.T) {
+	rule, err := ParseExpiryRule("dumps/* 24h")
+	assert.Nil(t, err)
+	assert.Equal(t, "dumps/* 24h0m0s", rule.String())
+	rule, err = ParseExpiryRule("secrets/* 0 1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rule.maxReads)
+
+	for _, malformed := range []string{"dumps/*", "dumps/* soon", "dumps/* -1h", "dumps/* 1h many", "[ 1h"} {
+		_, err = ParseExpiryRule(malformed)
+		assert.NotNil(t, err, malformed)
+	}
+}
+
+func TestExpiringStorageTTL(t *testing.T) {
+	rules := NewExpiryRules()
+	assert.Nil(t, rules.Set("dumps/* 1h"))
+	store := NewExpiringStorage(NewFileStore(), rules, 0)
+
+	dump := NewFileObject("dumps/core", []byte("core"))
+	assert.Nil(t, store.Put(dump))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), dump.Metadata().Expires, time.Minute)
+
+	stale := NewFileObject("boot/old.img", []byte("old"))
+	stale.SetMetadata(FileMetadata{Expires: time.Now().Add(-time.Second)})
+	assert.Nil(t, store.Put(stale))
+	assert.Nil(t, store.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	// Expired files are hidden before the janitor gets to them
+	assert.False(t, store.DoesFileExist("boot/old.img"))
+	_, err := store.Get("boot/old.img")
+	assert.NotNil(t, err)
+	assert.Len(t, store.Files(), 2)
+
+	assert.Equal(t, 1, store.Sweep())
+	assert.False(t, store.Storage.DoesFileExist("boot/old.img"))
+	assert.Equal(t, 0, store.Sweep())
+
+	// A new file takes the place of an expired one
+	stale.SetMetadata(FileMetadata{Expires: time.Now().Add(-time.Second)})
+	assert.Nil(t, store.Storage.Put(stale))
+	assert.Nil(t, store.Put(NewFileObject("boot/old.img", []byte("new"))))
+	assert.True(t, store.DoesFileExist("boot/old.img"))
+}
+
+func TestExpiringStorageMaxReads(t *testing.T) {
+	rules := NewExpiryRules()
+	assert.Nil(t, rules.Set("secrets/* 0 2"))
+	store := NewExpiringStorage(NewFileStore(), rules, 0)
+	assert.Nil(t, store.Put(NewFileObject("secrets/key", []byte("key"))))
+	assert.Nil(t, store.Put(NewFileObject("hello.txt", []byte("hello"))))
+
+	recordRead(NewVerifyingStorage(store), "secrets/key")
+	assert.True(t, store.DoesFileExist("secrets/key"))
+	recordRead(NewVerifyingStorage(store), "secrets/key")
+	assert.False(t, store.DoesFileExist("secrets/key"))
+
+	recordRead(store, "hello.txt")
+	recordRead(store, "hello.txt")
+	assert.True(t, store.DoesFileExist("hello.txt"))
+}
+
+func TestExpiringStorageReservesReads(t *testing.T) {
+	store := NewExpiringStorage(NewFileStore(), nil, 0)
+	file := NewFileObject("secrets/key", []byte("key"))
+	file.SetMetadata(FileMetadata{MaxReads: 2})
+	assert.Nil(t, store.Put(file))
+	verifying := NewVerifyingStorage(store)
+
+	// Reads in progress take the reads the file allows
+	assert.Nil(t, reserveRead(verifying, "secrets/key"))
+	assert.Nil(t, reserveRead(verifying, "secrets/key"))
+	assert.NotNil(t, reserveRead(verifying, "secrets/key"))
+
+	// A failed read gives its reservation back
+	releaseRead(verifying, "secrets/key")
+	assert.Nil(t, reserveRead(verifying, "secrets/key"))
+
+	recordRead(verifying, "secrets/key")
+	assert.True(t, store.DoesFileExist("secrets/key"))
+	assert.NotNil(t, reserveRead(verifying, "secrets/key"))
+	recordRead(verifying, "secrets/key")
+	assert.False(t, store.DoesFileExist("secrets/key"))
+	assert.Empty(t, store.reserved)
+}
+
+func TestExpiringStorageJanitor(t *testing.T) {
+	store := NewExpiringStorage(NewFileStore(), nil, 10*time.Millisecond)
+	file := NewFileObject("dumps/core", []byte("core"))
+	file.SetMetadata(FileMetadata{Expires: time.Now().Add(20 * time.Millisecond)})
+	assert.Nil(t, store.Put(file))
+
+	store.Start()
+	defer store.Stop()
+	assert.Eventually(t, func() bool {
+		return !store.Storage.DoesFileExist("dumps/core")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGatewayRecordsReads(t *testing.T) {
+	store := NewExpiringStorage(NewFileStore(), nil, 0)
+	file := NewFileObject("secrets/key", []byte("hello world"))
+	file.SetMetadata(FileMetadata{MaxReads: 1})
+	assert.Nil(t, store.Put(file))
+	gateway := NewHTTPGateway(store, nil, nil)
+
+	// Partial reads don't count
+	response := gatewayRequest(gateway, "/secrets/key", map[string]string{"Range": "bytes=6-"})
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.True(t, store.DoesFileExist("secrets/key"))
+
+	response = gatewayRequest(gateway, "/secrets/key", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.False(t, store.DoesFileExist("secrets/key"))
+}
@@ -1,28 +1,296 @@
 package tftputils
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// FileObject holds filename and data of a file
+// FileMetadata describes a stored file beyond its content
+type FileMetadata struct {
+	Created  time.Time
+	Modified time.Time
+	// Uploader is the address of the client that stored the file,
+	// Mode the TFTP transfer mode it was sent in, or "http"
+	Uploader    string
+	Mode        string
+	ContentType string
+	// Expires is when the file gets deleted, MaxReads the number of
+	// completed reads it is deleted after, zero values keep it forever
+	Expires  time.Time
+	MaxReads int
+}
+
+// expired tells whether the file is past its expiry time
+func (m FileMetadata) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// FileObject holds filename and content of a file,
+// the content is read on demand from any io.ReaderAt.
+// Its checksums are recorded when the file is received,
+// or computed from the content on first use.
 type FileObject struct {
-	filename string
-	data     []byte
+	filename   string
+	content    io.ReaderAt
+	size       int64
+	metadata   FileMetadata
+	digest     [sha256.Size]byte
+	crc32      uint32
+	digestOnce *sync.Once
+	// checksummed is set once the checksums are known,
+	// checksumErr tells why computing them failed
+	checksummed atomic.Bool
+	checksumErr error
 }
 
 func NewFileObject(filename string, data []byte) *FileObject {
+	return NewFileObjectReaderAt(filename, bytes.NewReader(data), int64(len(data)))
+}
+
+// NewFileObjectReaderAt creates a file of the given size
+// whose content is read from content as it is served
+func NewFileObjectReaderAt(filename string, content io.ReaderAt, size int64) *FileObject {
 	return &FileObject{
-		filename: filename,
-		data:     data,
+		filename:   filename,
+		content:    content,
+		size:       size,
+		digestOnce: &sync.Once{},
+	}
+}
+
+// diskFile reads a file on disk, opening it on first read
+// and again after it is closed
+type diskFile struct {
+	path  string
+	file  *os.File
+	mutex *sync.Mutex
+}
+
+func (d *diskFile) ReadAt(p []byte, off int64) (int, error) {
+	defer d.mutex.Unlock()
+	d.mutex.Lock()
+	if d.file == nil {
+		file, err := os.Open(d.path)
+		if err != nil {
+			return 0, err
+		}
+		d.file = file
+	}
+	return d.file.ReadAt(p, off)
+}
+
+func (d *diskFile) Close() error {
+	defer d.mutex.Unlock()
+	d.mutex.Lock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// OpenFileObject creates a file served from the file at path on disk,
+// read block by block through the page cache instead of loaded in memory.
+// The file stays open from the first read until the object is closed.
+func OpenFileObject(filename string, path string) (*FileObject, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("Cannot serve %v: not a regular file", path)
+	}
+	content := &diskFile{path: path, file: file, mutex: &sync.Mutex{}}
+	return NewFileObjectReaderAt(filename, content, info.Size()), nil
+}
+
+// Close releases what reading the content holds open, such as the file
+// on disk of an object from OpenFileObject. Reading again reopens it.
+func (f *FileObject) Close() error {
+	if closer, ok := f.content.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Size returns the size of the file in bytes
+func (f *FileObject) Size() int64 {
+	return f.size
+}
+
+// Metadata returns the metadata of the file, its times
+// are set once the file is stored
+func (f *FileObject) Metadata() FileMetadata {
+	return f.metadata
+}
+
+// SetMetadata sets the metadata of a file before it is stored,
+// times left zero are set by the storage
+func (f *FileObject) SetMetadata(metadata FileMetadata) {
+	f.metadata = metadata
+}
+
+// prepare computes what a storage records about a file from its
+// content, it reads the content so call it before taking any lock
+func (f *FileObject) prepare() {
+	f.SHA256()
+	if f.metadata.ContentType == "" {
+		f.metadata.ContentType = detectContentType(f.content, f.size)
+	}
+}
+
+// stamp sets the times of a file being stored,
+// keeping the creation time of the file it replaces if any
+func (f *FileObject) stamp(replaced *FileObject) {
+	now := time.Now()
+	if replaced != nil {
+		f.metadata.Created = replaced.metadata.Created
+	}
+	if f.metadata.Created.IsZero() {
+		f.metadata.Created = now
+	}
+	if f.metadata.Modified.IsZero() {
+		f.metadata.Modified = now
+	}
+}
+
+// detectContentType sniffs the content type from
+// the first bytes of the content
+func detectContentType(content io.ReaderAt, size int64) string {
+	head := make([]byte, 512)
+	if size < int64(len(head)) {
+		head = head[:size]
+	}
+	n, err := content.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head[:n])
+}
+
+// NewReader returns a reader over the whole content of the file,
+// every reader has its own offset so they can be used concurrently
+func (f *FileObject) NewReader() *io.SectionReader {
+	return io.NewSectionReader(f.content, 0, f.size)
+}
+
+// setChecksums records checksums already known for the content,
+// sparing reading it again. It must be called before any use of the file.
+func (f *FileObject) setChecksums(digest [sha256.Size]byte, crc uint32) {
+	f.digestOnce.Do(func() {
+		f.digest = digest
+		f.crc32 = crc
+		f.checksummed.Store(true)
+	})
+}
+
+// knownChecksums returns the checksums of the file when they were
+// recorded or computed already, without reading the content
+func (f *FileObject) knownChecksums() ([sha256.Size]byte, uint32, bool) {
+	if !f.checksummed.Load() {
+		return [sha256.Size]byte{}, 0, false
+	}
+	return f.digest, f.crc32, true
+}
+
+// SHA256 returns the digest of the file content
+func (f *FileObject) SHA256() [sha256.Size]byte {
+	f.digestOnce.Do(f.computeChecksums)
+	return f.digest
+}
+
+// CRC32 returns the IEEE CRC-32 of the file content
+func (f *FileObject) CRC32() uint32 {
+	f.digestOnce.Do(f.computeChecksums)
+	return f.crc32
+}
+
+func (f *FileObject) computeChecksums() {
+	digest, crc, err := checksumsOf(f.NewReader())
+	if err != nil {
+		f.checksumErr = err
+		return
+	}
+	f.digest, f.crc32 = digest, crc
+	f.checksummed.Store(true)
+}
+
+// Verify reads the content again and compares it
+// against the checksums recorded for the file
+func (f *FileObject) Verify() error {
+	expected := f.SHA256()
+	if f.checksumErr != nil {
+		return fmt.Errorf("Cannot verify %v: %v", f.filename, f.checksumErr)
+	}
+	digest, crc, err := checksumsOf(f.NewReader())
+	if err != nil {
+		return fmt.Errorf("Cannot verify %v: %v", f.filename, err)
+	}
+	if digest != expected || crc != f.CRC32() {
+		return fmt.Errorf("%v is corrupted, its checksum changed since it was stored", f.filename)
 	}
+	return nil
+}
+
+func checksumsOf(reader io.Reader) ([sha256.Size]byte, uint32, error) {
+	var digest [sha256.Size]byte
+	hash := sha256.New()
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(hash, crc), reader); err != nil {
+		return digest, 0, err
+	}
+	copy(digest[:], hash.Sum(nil))
+	return digest, crc.Sum32(), nil
+}
+
+// StoreLimits bounds how much a FileStore may hold,
+// zero values are unlimited
+type StoreLimits struct {
+	MaxTotalBytes int64
+	MaxFileBytes  int64
+	MaxFiles      int
+}
+
+// QuotaError is returned when storing a file
+// would exceed the store limits
+type QuotaError struct {
+	msg string
+}
+
+func (e *QuotaError) Error() string {
+	return e.msg
+}
+
+// IsQuotaError determines whether an error is caused by the store limits
+func IsQuotaError(err error) bool {
+	_, ok := err.(*QuotaError)
+	return ok
 }
 
 // FileStore holds a dictionary of fileObjects and
 // a mutex to protect from concurrent access
 type FileStore struct {
-	fileMap map[string]*FileObject
-	mutex   *sync.Mutex
+	fileMap    map[string]*FileObject
+	mutex      *sync.Mutex
+	limits     StoreLimits
+	totalBytes int64
+	version    uint64
 }
 
 func NewFileStore() *FileStore {
@@ -32,16 +300,102 @@ func NewFileStore() *FileStore {
 	}
 }
 
+// SetLimits changes the limits applied to files stored from now on
+func (fs *FileStore) SetLimits(limits StoreLimits) {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	fs.limits = limits
+}
+
 func (fs *FileStore) Put(file *FileObject) error {
+	// Record the checksums of the content as it is stored,
+	// before locking as it reads the whole content
+	file.prepare()
+
 	// Protect storage from concurrent writing
-	if fs.DoesFileExist(file.filename) {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	if _, ok := fs.fileMap[file.filename]; ok {
 		return fmt.Errorf("%v exists", file.filename)
 	}
+	if err := fs.checkQuota(file.size); err != nil {
+		return err
+	}
+
+	file.stamp(nil)
+	fs.fileMap[file.filename] = file
+	fs.totalBytes += file.size
+	fs.version++
+	return nil
+}
+
+// Replace stores a file, overwriting any file with the same name
+func (fs *FileStore) Replace(file *FileObject) error {
+	file.prepare()
 
 	defer fs.mutex.Unlock()
 	fs.mutex.Lock()
 
+	// Take the old file out so it doesn't count against the quota
+	old, exists := fs.fileMap[file.filename]
+	if exists {
+		delete(fs.fileMap, file.filename)
+		fs.totalBytes -= old.size
+	}
+	if err := fs.checkQuota(file.size); err != nil {
+		if exists {
+			fs.fileMap[file.filename] = old
+			fs.totalBytes += old.size
+		}
+		return err
+	}
+
+	file.stamp(old)
 	fs.fileMap[file.filename] = file
+	fs.totalBytes += file.size
+	fs.version++
+	return nil
+}
+
+// Delete removes a file from the store
+func (fs *FileStore) Delete(filename string) error {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	file, ok := fs.fileMap[filename]
+	if !ok {
+		return fmt.Errorf("%v does not exist", filename)
+	}
+	delete(fs.fileMap, filename)
+	fs.totalBytes -= file.size
+	fs.version++
+	return nil
+}
+
+// CheckQuota determines whether a new file of the given size
+// fits in the store, without reserving any space for it.
+func (fs *FileStore) CheckQuota(size int64) error {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	return fs.checkQuota(size)
+}
+
+// checkQuota does the work of CheckQuota,
+// the caller must hold the mutex
+func (fs *FileStore) checkQuota(size int64) error {
+	limits := fs.limits
+	if limits.MaxFileBytes > 0 && size > limits.MaxFileBytes {
+		return &QuotaError{fmt.Sprintf("File size %v exceeds the limit of %v bytes", size, limits.MaxFileBytes)}
+	}
+	if limits.MaxTotalBytes > 0 && fs.totalBytes+size > limits.MaxTotalBytes {
+		return &QuotaError{fmt.Sprintf("Storage is full, %v of %v bytes used", fs.totalBytes, limits.MaxTotalBytes)}
+	}
+	if limits.MaxFiles > 0 && len(fs.fileMap) >= limits.MaxFiles {
+		return &QuotaError{fmt.Sprintf("Storage is full, %v files stored", len(fs.fileMap))}
+	}
 	return nil
 }
 
@@ -58,6 +412,29 @@ func (fs *FileStore) Get(filename string) (*FileObject, error) {
 	return file, nil
 }
 
+// Files returns every stored file sorted by filename
+func (fs *FileStore) Files() []*FileObject {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	files := make([]*FileObject, 0, len(fs.fileMap))
+	for _, file := range fs.fileMap {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].filename < files[j].filename
+	})
+	return files
+}
+
+// Version changes every time the content of the store changes
+func (fs *FileStore) Version() uint64 {
+	defer fs.mutex.Unlock()
+	fs.mutex.Lock()
+
+	return fs.version
+}
+
 func (fs *FileStore) DoesFileExist(filename string) bool {
 	// Protect storage from concurrent reading
 	defer fs.mutex.Unlock()
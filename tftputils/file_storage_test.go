@@ -1,7 +1,11 @@
 package tftputils
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -39,3 +43,140 @@ func TestGetNonExistant(t *testing.T) {
 		assert.Equal(t, fmt.Errorf("%v does not exist", filename), err)
 	}
 }
+
+func TestPutOverFileLimit(t *testing.T) {
+	fileStorage := NewFileStore()
+	fileStorage.SetLimits(StoreLimits{MaxFileBytes: 2})
+	err := fileStorage.Put(NewFileObject("hello.txt", []byte{0x12, 0x33, 0x33}))
+	assert.True(t, IsQuotaError(err))
+	assert.False(t, fileStorage.DoesFileExist("hello.txt"))
+}
+
+func TestPutOverTotalLimit(t *testing.T) {
+	_, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+	fileStorage.SetLimits(StoreLimits{MaxTotalBytes: 5})
+
+	assert.Nil(t, fileStorage.CheckQuota(2))
+	assert.True(t, IsQuotaError(fileStorage.CheckQuota(3)))
+	err = fileStorage.Put(NewFileObject("world.txt", []byte{0x12, 0x33, 0x33}))
+	assert.True(t, IsQuotaError(err))
+}
+
+func TestPutOverFileCountLimit(t *testing.T) {
+	_, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+	fileStorage.SetLimits(StoreLimits{MaxFiles: 1})
+
+	err = fileStorage.Put(NewFileObject("world.txt", []byte{}))
+	assert.True(t, IsQuotaError(err))
+}
+
+func TestReplaceDelete(t *testing.T) {
+	file, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+
+	newFile := NewFileObject(file.filename, []byte{0x01})
+	assert.Nil(t, fileStorage.Replace(newFile))
+	actualFile, err := fileStorage.Get(file.filename)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, actualFile)
+
+	assert.Nil(t, fileStorage.Delete(file.filename))
+	assert.False(t, fileStorage.DoesFileExist(file.filename))
+	assert.NotNil(t, fileStorage.Delete(file.filename))
+}
+
+func TestMetadataStamping(t *testing.T) {
+	fileStorage := NewFileStore()
+	file := NewFileObject("hello.txt", []byte("hello"))
+	file.SetMetadata(FileMetadata{Uploader: "10.0.0.1", Mode: "octet"})
+	assert.Nil(t, fileStorage.Put(file))
+
+	metadata := file.Metadata()
+	assert.False(t, metadata.Created.IsZero())
+	assert.Equal(t, metadata.Created, metadata.Modified)
+	assert.Equal(t, "10.0.0.1", metadata.Uploader)
+	assert.Equal(t, "text/plain; charset=utf-8", metadata.ContentType)
+
+	newFile := NewFileObject("hello.txt", []byte{0x00, 0x01})
+	assert.Nil(t, fileStorage.Replace(newFile))
+	actualFile, err := fileStorage.Get("hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, metadata.Created, actualFile.Metadata().Created)
+	assert.False(t, actualFile.Metadata().Modified.Before(metadata.Modified))
+	assert.Empty(t, actualFile.Metadata().Uploader)
+	assert.Equal(t, "application/octet-stream", actualFile.Metadata().ContentType)
+}
+
+func TestOpenFileObject(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "simple_tftp_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	data := []byte("served from disk")
+	tempFile.Write(data)
+	tempFile.Close()
+
+	file, err := OpenFileObject("disk.txt", tempFile.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), file.Size())
+	assert.Equal(t, sha256.Sum256(data), file.SHA256())
+	content, err := ioutil.ReadAll(file.NewReader())
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+
+	// Closing releases the file, reading opens it again
+	disk := file.content.(*diskFile)
+	assert.Nil(t, file.Close())
+	assert.Nil(t, disk.file)
+	content, err = ioutil.ReadAll(file.NewReader())
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+	assert.NotNil(t, disk.file)
+	assert.Nil(t, file.Close())
+	assert.Nil(t, file.Close())
+
+	_, err = OpenFileObject("dir", os.TempDir())
+	assert.NotNil(t, err)
+	_, err = OpenFileObject("missing", tempFile.Name()+".missing")
+	assert.NotNil(t, err)
+}
+
+func TestFileObjectChecksums(t *testing.T) {
+	data := []byte("hello")
+	file := NewFileObject("hello.txt", data)
+	assert.Equal(t, sha256.Sum256(data), file.SHA256())
+	assert.Equal(t, crc32.ChecksumIEEE(data), file.CRC32())
+	assert.Nil(t, file.Verify())
+
+	data[0] = 'j'
+	assert.NotNil(t, file.Verify())
+	// The recorded checksums don't follow the content
+	assert.Equal(t, sha256.Sum256([]byte("hello")), file.SHA256())
+}
+
+func TestVerifyingStorage(t *testing.T) {
+	fileStorage := NewFileStore()
+	data := []byte("hello")
+	assert.Nil(t, fileStorage.Put(NewFileObject("hello.txt", data)))
+	verifying := NewVerifyingStorage(fileStorage)
+
+	_, err := verifying.Get("hello.txt")
+	assert.Nil(t, err)
+	data[0] = 'j'
+	_, err = verifying.Get("hello.txt")
+	assert.NotNil(t, err)
+	_, err = verifying.Get("missing")
+	assert.NotNil(t, err)
+
+	// Files without recorded checksums aren't read to be checked
+	root, cleanup := tempRoot(t, map[string]string{"boot.img": "boot"})
+	defer cleanup()
+	verifying = NewVerifyingStorage(NewDirStore(root))
+	file, err := verifying.Get("boot.img")
+	assert.Nil(t, err)
+	_, _, known := file.knownChecksums()
+	assert.False(t, known)
+}
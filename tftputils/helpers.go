@@ -1,27 +1,6 @@
 package tftputils
 
-import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-
-	"github.com/sirupsen/logrus"
-)
-
-func uint64ToBytes(num uint64) []byte {
-	bytes := make([]byte, Uint64BytesNum)
-	binary.BigEndian.PutUint64(bytes, num)
-	return bytes
-}
-
-func bytesToUint64(bytes []byte) (uint64, error) {
-	if len(bytes) > Uint64BytesNum {
-		return 0, errors.New("Bytes length is too long for Uint64")
-	}
-	pad := make([]byte, Uint64BytesNum-len(bytes))
-	completeBytes := append(pad, bytes...)
-	return binary.BigEndian.Uint64(completeBytes), nil
-}
+import "fmt"
 
 func validateMode(mode string) bool {
 	switch mode {
@@ -32,10 +11,10 @@ func validateMode(mode string) bool {
 	}
 }
 
-func validateModeAndNotify(mode string, udpUtils *UDPUtils) (bool, error) {
+func validateModeAndNotify(mode string, udpUtils *UDPUtils, logger Logger) (bool, error) {
 	if !validateMode(mode) {
 		msg := fmt.Sprintf("Mode %v not supported", mode)
-		logrus.Error(msg)
+		logger.Errorf("%v", msg)
 		return false, sendErrorPacket(UnknownTransferIDErr, msg, udpUtils)
 	}
 	return true, nil
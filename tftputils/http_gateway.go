@@ -0,0 +1,111 @@
+package tftputils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HTTPGateway serves the files of a file storage over HTTP
+// for clients that prefer it over TFTP, such as iPXE or UEFI HTTP boot.
+// The URL path is the filename, range requests and
+// conditional requests on the ETag are supported.
+type HTTPGateway struct {
+	fileStorage Storage
+	acl         *ACL
+	permissions *Permissions
+	logger      Logger
+}
+
+func NewHTTPGateway(fileS Storage, acl *ACL, permissions *Permissions) *HTTPGateway {
+	return &HTTPGateway{
+		fileStorage: fileS,
+		acl:         acl,
+		permissions: permissions,
+		logger:      defaultLogger,
+	}
+}
+
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	filename := strings.TrimPrefix(r.URL.Path, "/")
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientIP := net.ParseIP(host)
+	if !g.acl.IsAllowed(clientIP, filename) || !g.permissions.CanRead(filename) {
+		g.logger.Errorf("Access to %v denied for %v", filename, clientIP)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	file, err := g.fileStorage.Get(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	// A GET reserves a read of the file, a HEAD sends none of it
+	if r.Method == http.MethodGet {
+		if err := reserveRead(g.fileStorage, filename); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	metadata := file.Metadata()
+	w.Header().Set("ETag", entityTag(file))
+	if metadata.ContentType != "" {
+		w.Header().Set("Content-Type", metadata.ContentType)
+	}
+	g.logger.Infof("Serving %v to %v", filename, clientIP)
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(recorder, r, filename, metadata.Modified, file.NewReader())
+
+	// Only a whole file sent counts as a read, like a TFTP transfer
+	if r.Method != http.MethodGet {
+		return
+	}
+	if recorder.status == http.StatusOK && recorder.written == file.Size() {
+		recordRead(g.fileStorage, filename)
+	} else {
+		releaseRead(g.fileStorage, filename)
+	}
+}
+
+// entityTag returns the ETag of a file, its digest when recorded,
+// otherwise a weak tag from its size and modification time
+// so that the file isn't read whole before being served
+func entityTag(file *FileObject) string {
+	if digest, _, ok := file.knownChecksums(); ok {
+		return fmt.Sprintf("%q", hex.EncodeToString(digest[:]))
+	}
+	return fmt.Sprintf("W/\"%x-%x\"", file.Size(), file.Metadata().Modified.UnixNano())
+}
+
+// responseRecorder keeps track of the status and
+// the number of bytes of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(data)
+	rr.written += int64(n)
+	return n, err
+}
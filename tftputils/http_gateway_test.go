@@ -0,0 +1,78 @@
+package tftputils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gatewayRequest(gateway *HTTPGateway, path string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.RemoteAddr = "10.0.0.1:4000"
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestGatewayGet(t *testing.T) {
+	fileStorage := NewFileStore()
+	assert.Nil(t, fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("hello world"))))
+	gateway := NewHTTPGateway(fileStorage, nil, nil)
+
+	response := gatewayRequest(gateway, "/boot/pxelinux.0", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "hello world", response.Body.String())
+	assert.Equal(t, "11", response.Header().Get("Content-Length"))
+	assert.Equal(t, "text/plain; charset=utf-8", response.Header().Get("Content-Type"))
+	assert.NotEmpty(t, response.Header().Get("Last-Modified"))
+	etag := response.Header().Get("ETag")
+	assert.Equal(t, `"b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"`, etag)
+
+	response = gatewayRequest(gateway, "/boot/pxelinux.0", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.Code)
+
+	response = gatewayRequest(gateway, "/missing", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestGatewayRootFileETag(t *testing.T) {
+	root, cleanup := tempRoot(t, map[string]string{"boot.img": "boot"})
+	defer cleanup()
+	gateway := NewHTTPGateway(NewDirStore(root), nil, nil)
+
+	// Files without a recorded digest get a weak tag instead of being hashed
+	response := gatewayRequest(gateway, "/boot.img", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"4-`), etag)
+
+	response = gatewayRequest(gateway, "/boot.img", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.Code)
+}
+
+func TestGatewayRange(t *testing.T) {
+	fileStorage := NewFileStore()
+	assert.Nil(t, fileStorage.Put(NewFileObject("hello.txt", []byte("hello world"))))
+	gateway := NewHTTPGateway(fileStorage, nil, nil)
+
+	response := gatewayRequest(gateway, "/hello.txt", map[string]string{"Range": "bytes=6-"})
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, "world", response.Body.String())
+}
+
+func TestGatewayDenied(t *testing.T) {
+	fileStorage := NewFileStore()
+	assert.Nil(t, fileStorage.Put(NewFileObject("hello.txt", []byte("hello world"))))
+	acl := NewACL()
+	assert.Nil(t, acl.Set("allow 192.168.0.0/16"))
+	gateway := NewHTTPGateway(fileStorage, acl, nil)
+
+	response := gatewayRequest(gateway, "/hello.txt", nil)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+}
@@ -0,0 +1,238 @@
+package tftputils
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds how many per client rate buckets
+// are kept before idle ones get dropped
+const maxTrackedClients = 4096
+
+// TokenBucket refills tokens at a constant rate up to a burst size,
+// it is used both to limit request rates and to shape bandwidth.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+}
+
+// NewTokenBucket creates a full bucket, a burst
+// below one defaults to one second worth of tokens
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// refill adds the tokens earned since the last call,
+// the caller must hold the mutex
+func (tb *TokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// Allow takes a token if one is available without blocking.
+// A nil bucket is unlimited.
+func (tb *TokenBucket) Allow() bool {
+	if tb == nil {
+		return true
+	}
+
+	defer tb.mutex.Unlock()
+	tb.mutex.Lock()
+
+	tb.refill()
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// refund gives back a token taken by Allow
+func (tb *TokenBucket) refund() {
+	if tb == nil {
+		return
+	}
+
+	defer tb.mutex.Unlock()
+	tb.mutex.Lock()
+
+	tb.tokens++
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// Wait takes n tokens, blocking until the bucket has earned them.
+// n may exceed the burst size, the bucket then goes into debt
+// and later callers wait for it to be paid back.
+func (tb *TokenBucket) Wait(n int) {
+	if tb == nil {
+		return
+	}
+
+	tb.mutex.Lock()
+	tb.refill()
+	tb.tokens -= float64(n)
+	deficit := -tb.tokens
+	tb.mutex.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / tb.rate * float64(time.Second)))
+	}
+}
+
+// full reports whether the bucket has refilled completely,
+// which means the client has been idle for a while
+func (tb *TokenBucket) full() bool {
+	defer tb.mutex.Unlock()
+	tb.mutex.Lock()
+
+	tb.refill()
+	return tb.tokens >= tb.burst
+}
+
+// RequestLimiter limits the rate of incoming requests
+// globally and per client ip. Zero rates are unlimited.
+type RequestLimiter struct {
+	global      *TokenBucket
+	clientRate  float64
+	clientBurst int
+	clients     map[string]*TokenBucket
+	mutex       *sync.Mutex
+}
+
+func NewRequestLimiter(rate float64, burst int, clientRate float64, clientBurst int) *RequestLimiter {
+	var global *TokenBucket
+	if rate > 0 {
+		global = NewTokenBucket(rate, burst)
+	}
+	return &RequestLimiter{
+		global:      global,
+		clientRate:  clientRate,
+		clientBurst: clientBurst,
+		clients:     make(map[string]*TokenBucket),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// Allow determines whether a request from the ip may proceed.
+// A token is only taken when both the global and the client
+// buckets allow the request, so that a flood refused globally
+// doesn't use up the tokens of every other client.
+func (rl *RequestLimiter) Allow(ip net.IP) bool {
+	if !rl.global.Allow() {
+		return false
+	}
+	if !rl.clientBucket(ip).Allow() {
+		rl.global.refund()
+		return false
+	}
+	return true
+}
+
+func (rl *RequestLimiter) clientBucket(ip net.IP) *TokenBucket {
+	if rl.clientRate <= 0 {
+		return nil
+	}
+
+	defer rl.mutex.Unlock()
+	rl.mutex.Lock()
+
+	key := ip.String()
+	bucket, ok := rl.clients[key]
+	if !ok {
+		if len(rl.clients) >= maxTrackedClients {
+			rl.dropIdleClients()
+		}
+		bucket = NewTokenBucket(rl.clientRate, rl.clientBurst)
+		rl.clients[key] = bucket
+	}
+	return bucket
+}
+
+// dropIdleClients forgets clients whose bucket is full again,
+// the caller must hold the mutex
+func (rl *RequestLimiter) dropIdleClients() {
+	for key, bucket := range rl.clients {
+		if bucket.full() {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// SessionLimiter caps the number of concurrent sessions
+// globally and per client ip. Zero limits are unlimited.
+type SessionLimiter struct {
+	max          int
+	maxPerClient int
+	total        int
+	clients      map[string]int
+	mutex        *sync.Mutex
+}
+
+func NewSessionLimiter(max int, maxPerClient int) *SessionLimiter {
+	return &SessionLimiter{
+		max:          max,
+		maxPerClient: maxPerClient,
+		clients:      make(map[string]int),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// Acquire reserves a session slot for the ip, every successful
+// Acquire must be followed by a Release once the session ends.
+func (sl *SessionLimiter) Acquire(ip net.IP) bool {
+	defer sl.mutex.Unlock()
+	sl.mutex.Lock()
+
+	key := ip.String()
+	if sl.max > 0 && sl.total >= sl.max {
+		return false
+	}
+	if sl.maxPerClient > 0 && sl.clients[key] >= sl.maxPerClient {
+		return false
+	}
+	sl.total++
+	sl.clients[key]++
+	return true
+}
+
+func (sl *SessionLimiter) Release(ip net.IP) {
+	defer sl.mutex.Unlock()
+	sl.mutex.Lock()
+
+	key := ip.String()
+	sl.total--
+	sl.clients[key]--
+	if sl.clients[key] <= 0 {
+		delete(sl.clients, key)
+	}
+}
+
+// Active returns the number of sessions currently running
+func (sl *SessionLimiter) Active() int {
+	defer sl.mutex.Unlock()
+	sl.mutex.Lock()
+
+	return sl.total
+}
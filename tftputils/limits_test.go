@@ -0,0 +1,183 @@
+package tftputils
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	bucket := NewTokenBucket(1, 2)
+	assert.True(t, bucket.Allow())
+	assert.True(t, bucket.Allow())
+	assert.False(t, bucket.Allow())
+
+	var nilBucket *TokenBucket
+	assert.True(t, nilBucket.Allow())
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := NewTokenBucket(1000, 100)
+	start := time.Now()
+	bucket.Wait(100)
+	bucket.Wait(50)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestRequestLimiterPerClient(t *testing.T) {
+	limiter := NewRequestLimiter(0, 0, 1, 1)
+	first := net.ParseIP("10.0.0.1")
+	second := net.ParseIP("10.0.0.2")
+
+	assert.True(t, limiter.Allow(first))
+	assert.False(t, limiter.Allow(first))
+	assert.True(t, limiter.Allow(second))
+}
+
+func TestRequestLimiterGlobal(t *testing.T) {
+	limiter := NewRequestLimiter(1, 1, 0, 0)
+	assert.True(t, limiter.Allow(net.ParseIP("10.0.0.1")))
+	assert.False(t, limiter.Allow(net.ParseIP("10.0.0.2")))
+}
+
+func TestRequestLimiterTakesBothTokens(t *testing.T) {
+	limiter := NewRequestLimiter(0.001, 2, 0.001, 1)
+	first := net.ParseIP("10.0.0.1")
+	second := net.ParseIP("10.0.0.2")
+	third := net.ParseIP("10.0.0.3")
+
+	// A request refused per client gives its global token back
+	assert.True(t, limiter.Allow(first))
+	assert.False(t, limiter.Allow(first))
+	assert.True(t, limiter.Allow(second))
+
+	// A request refused globally keeps the token of its client
+	assert.False(t, limiter.Allow(third))
+	limiter.global.refund()
+	assert.True(t, limiter.Allow(third))
+}
+
+func TestSessionLimiter(t *testing.T) {
+	limiter := NewSessionLimiter(3, 2)
+	first := net.ParseIP("10.0.0.1")
+	second := net.ParseIP("10.0.0.2")
+
+	assert.True(t, limiter.Acquire(first))
+	assert.True(t, limiter.Acquire(first))
+	assert.False(t, limiter.Acquire(first))
+	assert.True(t, limiter.Acquire(second))
+	assert.False(t, limiter.Acquire(second))
+	assert.Equal(t, 3, limiter.Active())
+
+	limiter.Release(first)
+	assert.True(t, limiter.Acquire(second))
+}
+
+func TestAbandonedSessionReleasesLimits(t *testing.T) {
+	config := NewServerConfig()
+	config.MaxClientSessions = 1
+	config.Timeout = 20 * time.Millisecond
+	config.Retries = 1
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	// A client asking for the file then going silent
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(RRQ, "boot/pxelinux.0", OCTET), serverAddr))
+	_, _, err = client.ReadFromConn()
+	assert.Nil(t, err)
+
+	for deadline := time.Now().Add(time.Second); server.sessionLimiter.Active() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.sessionLimiter.Active())
+	assert.Empty(t, server.transfers.List())
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, _, err := upstream.Fetch("boot/pxelinux.0")
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "boot", string(data))
+	}
+}
+
+// versionedStorage changes version on every call,
+// so that the case insensitive lookup lists it every time
+type versionedStorage struct {
+	countingFilesStorage
+	version uint64
+}
+
+func (v *versionedStorage) Version() uint64 {
+	v.version++
+	return v.version
+}
+
+func TestRateLimitedRequestsSkipRewriting(t *testing.T) {
+	config := NewServerConfig()
+	config.ClientRequestRate = 0.001
+	config.ClientRequestBurst = 1
+	config.Rewriter = NewRewriter()
+	config.Rewriter.CaseInsensitive = true
+	config.Timeout = 20 * time.Millisecond
+	config.Retries = 1
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &versionedStorage{countingFilesStorage: countingFilesStorage{Storage: server.fileStorage}}
+	server.folds = newFoldIndex(storage)
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+
+	// The first request is looked up, the second
+	// is refused before the storage is listed again
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(RRQ, "BOOT/PXELINUX.0", OCTET), serverAddr))
+	packet, _, err := client.ReadFromConn()
+	assert.Nil(t, err)
+	opCode, _ := getOpCode(packet)
+	assert.Equal(t, uint16(DATA), opCode)
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(RRQ, "BOOT/PXELINUX.0", OCTET), serverAddr))
+	for {
+		packet, _, err = client.ReadFromConn()
+		if !assert.Nil(t, err) {
+			break
+		}
+		if opCode, _ = getOpCode(packet); opCode == ERROR {
+			message, _ := getErrorMessage(packet)
+			assert.Contains(t, message, "Request rate exceeded")
+			break
+		}
+	}
+	server.folds.mutex.Lock()
+	defer server.folds.mutex.Unlock()
+	assert.Equal(t, 1, storage.listings)
+}
@@ -0,0 +1,67 @@
+package tftputils
+
+// Listener is a socket the server receives requests on,
+// along with the multiplexer of its sessions in single port mode
+type Listener struct {
+	udpUtils *UDPUtils
+	mux      *SessionMux
+	reader   *batchReader
+	single   [1]*Packet
+}
+
+// NewListener listens on address, with a batchSize above one
+// datagrams are received, and sent in single port mode,
+// that many at a time where the platform supports it
+func NewListener(address string, singlePort bool, batchSize int) (*Listener, error) {
+	return newListener(address, singlePort, batchSize, defaultLogger)
+}
+
+// newListener creates a listener whose socket errors go to logger
+func newListener(address string, singlePort bool, batchSize int, logger Logger) (*Listener, error) {
+	udpUtils, err := NewUDPUtils(address, "")
+	if err != nil {
+		return nil, err
+	}
+	udpUtils.logger = logger
+	udpUtils.enablePacketInfo()
+	logger.Infof("Listening UDP at %v", udpUtils.connection.LocalAddr())
+
+	listener := &Listener{udpUtils: udpUtils}
+	if batchSupported && batchSize > 1 {
+		listener.reader = newBatchReader(udpUtils, batchSize)
+		if singlePort {
+			udpUtils.batch = newBatchWriter(udpUtils, batchSize)
+			udpUtils.onClose(udpUtils.batch.stop)
+		}
+	}
+	if singlePort {
+		listener.mux = NewSessionMux(udpUtils)
+	}
+	return listener, nil
+}
+
+// readPackets returns the next datagrams received by the listener,
+// the slice returned is reused by the next call
+func (l *Listener) readPackets() ([]*Packet, error) {
+	if l.reader != nil {
+		return l.reader.readPackets()
+	}
+	packet, err := l.udpUtils.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	l.single[0] = packet
+	return l.single[:], nil
+}
+
+// sessionHost returns the host a session answering a request binds to,
+// the local address the request was sent to when known so the client
+// sees replies coming from the address it talked to.
+func (l *Listener) sessionHost(request *Packet) string {
+	if request.Local != nil {
+		if host := hostOf(request.Local.IP, request.Local.Zone); host != "" {
+			return host
+		}
+	}
+	return hostOf(l.udpUtils.addr.IP, l.udpUtils.addr.Zone)
+}
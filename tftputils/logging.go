@@ -0,0 +1,124 @@
+package tftputils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are the key value pairs a Logger attaches to its entries
+type Fields map[string]interface{}
+
+// Logger is what the server logs through, every session logging
+// through one carrying its session_id, client, filename, mode,
+// options and direction. NewLogrusLogger and NewSlogLogger
+// adapt the loggers of logrus and log/slog.
+type Logger interface {
+	WithFields(fields Fields) Logger
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger is used unless the server is given another logger
+var defaultLogger = NewLogrusLogger(logrus.StandardLogger())
+
+// ConfigureLogrus sets the format, "text" or "json",
+// and the level, such as "debug" or "warn", of a logrus logger
+func ConfigureLogrus(logger *logrus.Logger, format string, level string) error {
+	switch format {
+	case "", "text":
+		logger.Formatter = &logrus.TextFormatter{}
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format %q, expected text or json", format)
+	}
+	if level == "" {
+		return nil
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.Level = parsed
+	return nil
+}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func NewLogrusLogger(logger *logrus.Logger) Logger {
+	return &logrusLogger{entry: logrus.NewEntry(logger)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) Debugf(format string, args ...interface{}) {
+	l.entry.Debugf(format, args...)
+}
+
+func (l *logrusLogger) Infof(format string, args ...interface{}) {
+	l.entry.Infof(format, args...)
+}
+
+func (l *logrusLogger) Warnf(format string, args ...interface{}) {
+	l.entry.Warnf(format, args...)
+}
+
+func (l *logrusLogger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+// WithFields adds the fields sorted by key, for stable output
+func (l *slogLogger) WithFields(fields Fields) Logger {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return &slogLogger{logger: l.logger.With(args...)}
+}
+
+// log only formats the message when the level is enabled
+func (l *slogLogger) log(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if l.logger.Enabled(ctx, level) {
+		l.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *slogLogger) Debugf(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args...)
+}
+
+func (l *slogLogger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args...)
+}
+
+func (l *slogLogger) Warnf(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args...)
+}
+
+func (l *slogLogger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args...)
+}
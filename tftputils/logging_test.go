@@ -0,0 +1,127 @@
+package tftputils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer collects the logs of concurrent sessions
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+	return b.buffer.Write(p)
+}
+
+// entries decodes the JSON lines written so far
+func (b *lockedBuffer) entries(t *testing.T) []map[string]interface{} {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+
+	entries := []map[string]interface{}{}
+	if b.buffer.Len() == 0 {
+		return entries
+	}
+	for _, line := range strings.Split(strings.TrimSpace(b.buffer.String()), "\n") {
+		entry := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestConfigureLogrus(t *testing.T) {
+	logger := logrus.New()
+	output := &lockedBuffer{}
+	logger.Out = output
+	assert.Nil(t, ConfigureLogrus(logger, "json", "warn"))
+	assert.Equal(t, logrus.WarnLevel, logger.Level)
+
+	wrapped := NewLogrusLogger(logger).WithFields(Fields{"session_id": 7})
+	wrapped.Infof("hidden")
+	wrapped.Warnf("Dropping packet from %v", "10.0.0.1:1024")
+	entries := output.entries(t)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Dropping packet from 10.0.0.1:1024", entries[0]["msg"])
+		assert.Equal(t, float64(7), entries[0]["session_id"])
+	}
+
+	assert.NotNil(t, ConfigureLogrus(logger, "xml", ""))
+	assert.NotNil(t, ConfigureLogrus(logger, "text", "loud"))
+}
+
+func TestSlogLogger(t *testing.T) {
+	output := &lockedBuffer{}
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(output, nil)))
+
+	logger = logger.WithFields(Fields{"filename": "boot/pxelinux.0", "client": "10.0.0.1:1024"})
+	logger.Debugf("hidden")
+	logger.Errorf("File %v does not exist in the server", "boot/pxelinux.0")
+	entries := output.entries(t)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "ERROR", entries[0]["level"])
+		assert.Equal(t, "File boot/pxelinux.0 does not exist in the server", entries[0]["msg"])
+		assert.Equal(t, "10.0.0.1:1024", entries[0]["client"])
+		assert.Equal(t, "boot/pxelinux.0", entries[0]["filename"])
+	}
+}
+
+func TestSessionLogFields(t *testing.T) {
+	output := &lockedBuffer{}
+	config := NewServerConfig()
+	config.Logger = NewSlogLogger(slog.New(slog.NewJSONHandler(output, nil)))
+	assert.Nil(t, config.Rewriter.Set("r ^/tftpboot/ boot/"))
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, _, err := upstream.Fetch("/tftpboot/pxelinux.0")
+	if assert.Nil(t, err) {
+		ioutil.ReadAll(body)
+		body.Close()
+	}
+
+	// The session may still be running once the file is received
+	var started map[string]interface{}
+	for deadline := time.Now().Add(time.Second); started == nil && time.Now().Before(deadline); {
+		for _, entry := range output.entries(t) {
+			if strings.HasPrefix(entry["msg"].(string), "Starting") {
+				started = entry
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NotNil(t, started) {
+		assert.Equal(t, float64(1), started["session_id"])
+		assert.Equal(t, ReadDirection, started["direction"])
+		assert.Equal(t, "boot/pxelinux.0", started["filename"])
+		assert.Equal(t, "/tftpboot/pxelinux.0", started["requested"])
+		assert.Equal(t, OCTET, started["mode"])
+		assert.Contains(t, started["client"], "127.0.0.1:")
+	}
+
+	// Socket messages go to the logger given too
+	listening := false
+	for _, entry := range output.entries(t) {
+		listening = listening || strings.HasPrefix(entry["msg"].(string), "Listening UDP at")
+	}
+	assert.True(t, listening)
+}
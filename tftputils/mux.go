@@ -0,0 +1,117 @@
+package tftputils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// muxQueueLength is how many packets may wait for a multiplexed
+// session before further ones are dropped
+const muxQueueLength = 16
+
+// SessionMux runs every session over the listening connection
+// of the server, demultiplexing the packets it receives
+// by client address to the session talking to that client.
+// A request from a client whose session has been idle for
+// idleTimeout replaces that session, as the client started over.
+type SessionMux struct {
+	listener    *UDPUtils
+	sessions    map[string]*muxSession
+	idleTimeout time.Duration
+	logger      Logger
+	mutex       *sync.Mutex
+}
+
+// muxSession is a session of the mux along with
+// when it last received a packet
+type muxSession struct {
+	conn     *UDPUtils
+	lastSeen time.Time
+}
+
+func NewSessionMux(udpUtils *UDPUtils) *SessionMux {
+	return &SessionMux{
+		listener:    udpUtils,
+		sessions:    make(map[string]*muxSession),
+		idleTimeout: defaultTimeout,
+		logger:      defaultLogger,
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// Open creates the connection of a session answering a request,
+// from the local address the request was sent to
+func (m *SessionMux) Open(request *Packet) (*UDPUtils, error) {
+	defer m.mutex.Unlock()
+	m.mutex.Lock()
+
+	key := request.Remote.String()
+	if _, ok := m.sessions[key]; ok {
+		return nil, fmt.Errorf("A session with %v is already running", key)
+	}
+
+	var session *UDPUtils
+	session = newMultiplexedUDPUtils(m.listener, request, func() {
+		m.remove(key, session)
+	})
+	m.sessions[key] = &muxSession{conn: session, lastSeen: time.Now()}
+	return session, nil
+}
+
+func (m *SessionMux) remove(key string, session *UDPUtils) {
+	defer m.mutex.Unlock()
+	m.mutex.Lock()
+
+	if entry, ok := m.sessions[key]; ok && entry.conn == session {
+		delete(m.sessions, key)
+	}
+}
+
+// Dispatch hands a packet over to the session talking to its sender,
+// it returns false when there is no such session and the packet
+// is a new request for the server to resolve.
+// Once dispatched, the buffer of the packet belongs to the session.
+func (m *SessionMux) Dispatch(packet *Packet) bool {
+	addr := packet.Remote
+	key := addr.String()
+	opCode, err := getOpCode(packet.Data)
+	isRequest := err == nil && (opCode == RRQ || opCode == WRQ)
+
+	m.mutex.Lock()
+	entry, ok := m.sessions[key]
+	if !ok {
+		m.mutex.Unlock()
+		return false
+	}
+	if isRequest && time.Since(entry.lastSeen) >= m.idleTimeout {
+		// The client started over, such as a PXE client rebooting
+		// with the same port, the request is resolved anew
+		delete(m.sessions, key)
+		m.mutex.Unlock()
+		m.logger.Warnf("Replacing the idle session with %v by its new request", addr)
+		entry.conn.CloseConnection()
+		return false
+	}
+	if !isRequest {
+		entry.lastSeen = time.Now()
+	}
+	session := entry.conn
+	m.mutex.Unlock()
+
+	// A client repeating its request while the session runs
+	// would only confuse the session, let it be
+	if isRequest {
+		m.logger.Warnf("Ignoring repeated request from %v", addr)
+		packet.release()
+		return true
+	}
+
+	select {
+	case session.incoming <- packet.buffer():
+	default:
+		m.logger.Warnf("Dropping packet from %v, session is falling behind", addr)
+		packet.release()
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package tftputils
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionMuxDispatch(t *testing.T) {
+	listener, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.CloseConnection()
+	mux := NewSessionMux(listener)
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4001}
+	session, err := mux.Open(&Packet{Remote: client})
+	assert.Nil(t, err)
+	_, err = mux.Open(&Packet{Remote: client})
+	assert.NotNil(t, err)
+
+	ack := []byte{0x00, 0x04, 0x00, 0x01}
+	assert.True(t, mux.Dispatch(&Packet{Data: ack, Remote: client}))
+	assert.False(t, mux.Dispatch(&Packet{Data: ack, Remote: other}))
+	readMessage, addr, err := session.ReadFromConn()
+	assert.Nil(t, err)
+	assert.Equal(t, client, addr)
+	assert.Equal(t, ack, readMessage)
+
+	session.CloseConnection()
+	_, _, err = session.ReadFromConn()
+	assert.NotNil(t, err)
+	assert.False(t, mux.Dispatch(&Packet{Data: ack, Remote: client}))
+}
+
+func TestSessionMuxIgnoresRepeatedRequest(t *testing.T) {
+	listener, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.CloseConnection()
+	mux := NewSessionMux(listener)
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}
+	session, err := mux.Open(&Packet{Remote: client})
+	assert.Nil(t, err)
+	defer session.CloseConnection()
+
+	request := []byte{0x00, 0x01, 0x68, 0x69, 0x00, 0x6f, 0x63, 0x74, 0x65, 0x74, 0x00}
+	assert.True(t, mux.Dispatch(&Packet{Data: request, Remote: client}))
+	assert.Empty(t, session.incoming)
+}
+
+func TestSessionMuxReplacesIdleSession(t *testing.T) {
+	listener, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.CloseConnection()
+	mux := NewSessionMux(listener)
+	mux.idleTimeout = 20 * time.Millisecond
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}
+	session, err := mux.Open(&Packet{Remote: client})
+	assert.Nil(t, err)
+
+	// Packets keep the session from going idle
+	ack := []byte{0x00, 0x04, 0x00, 0x01}
+	request := createRequestPacket(RRQ, "boot/pxelinux.0", OCTET)
+	time.Sleep(15 * time.Millisecond)
+	assert.True(t, mux.Dispatch(&Packet{Data: ack, Remote: client}))
+	_, _, err = session.ReadFromConn()
+	assert.Nil(t, err)
+	time.Sleep(15 * time.Millisecond)
+	assert.True(t, mux.Dispatch(&Packet{Data: request, Remote: client}))
+
+	// A request once the session is idle closes it, the request
+	// being resolved by the server to start a new session
+	time.Sleep(30 * time.Millisecond)
+	assert.False(t, mux.Dispatch(&Packet{Data: request, Remote: client}))
+	_, _, err = session.ReadFromConn()
+	assert.NotNil(t, err)
+	replacement, err := mux.Open(&Packet{Remote: client})
+	assert.Nil(t, err)
+	replacement.CloseConnection()
+}
+
+func TestSinglePortClientStartingOver(t *testing.T) {
+	config := NewServerConfig()
+	config.SinglePort = true
+	config.Timeout = 20 * time.Millisecond
+	config.Retries = 10
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	request := createRequestPacket(RRQ, "boot/pxelinux.0", OCTET)
+	assert.Nil(t, client.WriteToAddr(request, serverAddr))
+	_, _, err = client.ReadFromConn()
+	assert.Nil(t, err)
+
+	// The client reboots and asks again from the same port,
+	// instead of answering the session it abandoned
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, client.WriteToAddr(request, serverAddr))
+	assert.Equal(t, "boot", string(readFromSession(t, client)))
+	for deadline := time.Now().Add(time.Second); server.sessionLimiter.Active() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.sessionLimiter.Active())
+}
+
+func TestSinglePortStrayPackets(t *testing.T) {
+	config := NewServerConfig()
+	config.SinglePort = true
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+
+	// Blocks of a transfer that is over are refused,
+	// packets that make no sense dropped
+	for _, stray := range [][]byte{createDataPacket(3, []byte("late")), createAckPacket(2)} {
+		assert.Nil(t, client.WriteToAddr(stray, serverAddr))
+		packet, _, err := client.ReadFromConn()
+		assert.Nil(t, err)
+		opCode, _ := getOpCode(packet)
+		if assert.Equal(t, uint16(ERROR), opCode) {
+			assert.Equal(t, uint8(UnknownTransferIDErr), packet[3])
+		}
+	}
+	assert.Nil(t, client.WriteToAddr([]byte{0x00, 0x09}, serverAddr))
+	assert.Nil(t, client.WriteToAddr([]byte{0x00}, serverAddr))
+
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(RRQ, "boot/pxelinux.0", OCTET), serverAddr))
+	assert.Equal(t, "boot", string(readFromSession(t, client)))
+	select {
+	case err := <-served:
+		t.Fatalf("Server stopped: %v", err)
+	default:
+	}
+}
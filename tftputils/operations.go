@@ -1,42 +1,71 @@
 package tftputils
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
 )
 
 // RequestInfo holds the initial request info from client
-// which is filename and mode
+// which is filename, mode, any options (RFC 2347)
+// and the address the request came from, along with
+// the logger and the audit sink of the session serving it
 type RequestInfo struct {
 	filename string
 	mode     string
+	options  map[string]string
+	remote   *net.UDPAddr
+	logger   Logger
+	audit    AuditSink
 }
 
+// sendAckPacket and sendDataPacket reuse the send buffer of the
+// connection, they must only be called by the goroutine running the session
 func sendAckPacket(blockLoc uint16, udpUtils *UDPUtils) error {
-	packet := createAckPacket(blockLoc)
-	return udpUtils.WriteToConn(packet)
+	packet := appendAckPacket(udpUtils.sendBuffer(), blockLoc)
+	return udpUtils.send(packet)
 }
 
 func sendErrorPacket(errCode uint8, errMessage string, udpUtils *UDPUtils) error {
 	packet := createErrorPacket(errCode, errMessage)
+	udpUtils.lastError.Store(&tftpError{code: uint16(errCode), message: errMessage})
 	return udpUtils.WriteToConn(packet)
 }
 
+// sendErrorPacketTo answers a request received on a listening
+// connection, from the local address the request was sent to.
+// A reply failing to go out is logged by the connection, servers
+// refusing a request ignore the error to keep serving the others.
+func sendErrorPacketTo(errCode uint8, errMessage string, udpUtils *UDPUtils, request *Packet) error {
+	packet := createErrorPacket(errCode, errMessage)
+	return udpUtils.WriteToAddrFrom(packet, request.Remote, request.localIP(), request.ifIndex)
+}
+
 func sendDataPacket(block uint16, data []byte, udpUtils *UDPUtils) error {
-	packet := createDataPacket(block, data)
-	return udpUtils.WriteToConn(packet)
+	packet := appendDataPacket(udpUtils.sendBuffer(), block, data)
+	udpUtils.keepSendBuffer(packet)
+	return udpUtils.send(packet)
 }
 
 // We should be able to tolerate an error coming from client
-// for now
-func handleError(packet []byte) error {
+// for now, it is remembered by the session connection, if any
+func handleError(packet []byte, udpUtils *UDPUtils, logger Logger) error {
 	msg, err := getErrorMessage(packet)
 	if err != nil {
 		return err
 	}
-	logrus.Error(msg)
+	logger.Errorf("%v", msg)
+	if udpUtils != nil {
+		udpUtils.lastError.Store(&tftpError{
+			code:     binary.BigEndian.Uint16(packet[2:]),
+			message:  string(packet[4 : len(packet)-1]),
+			received: true,
+		})
+	}
 	return nil
 }
 
@@ -48,11 +77,7 @@ func getOpCode(input []byte) (uint16, error) {
 	if len(input) < 2 {
 		return UNKNOWNOP, errors.New("Not enough bytes to get the opcode")
 	}
-	opInt, err := bytesToUint64(input[:2])
-	if err != nil {
-		return UNKNOWNOP, err
-	}
-	return uint16(opInt), nil
+	return binary.BigEndian.Uint16(input), nil
 }
 
 func getRequestInfo(input []byte) (string, string, error) {
@@ -94,14 +119,85 @@ func getRequestInfo(input []byte) (string, string, error) {
 	return "", "", errors.New("Cannot parse input")
 }
 
+//  string   1 byte   string   1 byte
+// ------------------------------------  ...
+// |  opt1  |   0   |  value1  |   0   |
+// ------------------------------------  ...
+// Options follow the mode, option names are case insensitive.
+// Malformed trailing options are ignored.
+func getRequestOptions(input []byte) map[string]string {
+	options := make(map[string]string)
+	if len(input) < 2 {
+		return options
+	}
+
+	// Skip filename and mode, the remaining fields come in pairs
+	fields := bytes.Split(input[2:], []byte{0})
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		if name == "" {
+			break
+		}
+		options[name] = string(fields[i+1])
+	}
+	return options
+}
+
+// getOptionAck returns the options of an option acknowledgment (RFC 2347)
+func getOptionAck(input []byte) map[string]string {
+	options := make(map[string]string)
+	if len(input) < 2 {
+		return options
+	}
+	fields := bytes.Split(input[2:], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return options
+}
+
 func createRequestInfo(packetBytes []byte) (*RequestInfo, error) {
 	filename, mode, err := getRequestInfo(packetBytes)
 	return &RequestInfo{
 		filename: filename,
 		mode:     mode,
+		options:  getRequestOptions(packetBytes),
 	}, err
 }
 
+// Remote returns the address of the client that sent the request
+func (r *RequestInfo) Remote() *net.UDPAddr {
+	return r.remote
+}
+
+// Expand replaces the \i, \x and \p escapes of a template with the
+// IP address, hex IP address and port of the client, letting handlers
+// pick per client content, e.g. "configs/\i/config.txt"
+func (r *RequestInfo) Expand(template string) string {
+	return expandClient(template, r.remote)
+}
+
+// log returns the logger of the session serving the request
+func (r *RequestInfo) log() Logger {
+	if r == nil || r.logger == nil {
+		return defaultLogger
+	}
+	return r.logger
+}
+
+// transferSize returns the tsize option (RFC 2349) of the request
+func (r *RequestInfo) transferSize() (int64, bool) {
+	value, ok := r.options["tsize"]
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
 // 2 bytes     2 bytes
 // ---------------------
 // | Opcode |   Block #  |
@@ -110,11 +206,7 @@ func getAck(input []byte) (uint16, error) {
 	if len(input) < 4 {
 		return 0, errors.New("Not enough bytes to get block info")
 	}
-	block, err := bytesToUint64(input[2:4])
-	if err != nil {
-		return 0, err
-	}
-	return uint16(block), nil
+	return binary.BigEndian.Uint16(input[2:]), nil
 }
 
 // 2 bytes     2 bytes      n bytes
@@ -136,10 +228,7 @@ func getErrorMessage(input []byte) (string, error) {
 	if len(input) < 5 {
 		return "", errors.New("Not enough bytes to get error message")
 	}
-	errCode, err := bytesToUint64(input[2:4])
-	if err != nil {
-		return "", err
-	}
+	errCode := binary.BigEndian.Uint16(input[2:4])
 	errMessage := string(input[4 : len(input)-1])
 	return fmt.Sprintf("Error from client. Code: %v, Message: %v", errCode, string(errMessage)), nil
 }
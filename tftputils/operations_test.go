@@ -140,6 +140,27 @@ func TestCreateRequestInfoBad(t *testing.T) {
 	assert.Equal(t, "", reqInfo.mode)
 }
 
+func TestCreateRequestInfoOptions(t *testing.T) {
+	bytes := append([]byte{0x00, 0x02}, []byte("hi\x00octet\x00TSIZE\x001024\x00blksize\x001428\x00")...)
+	reqInfo, err := createRequestInfo(bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"tsize": "1024", "blksize": "1428"}, reqInfo.options)
+
+	size, ok := reqInfo.transferSize()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1024), size)
+}
+
+func TestCreateRequestInfoNoOptions(t *testing.T) {
+	bytes := []byte{0x00, 0x01, 0x68, 0x69, 0x00, 0x6f, 0x63, 0x74, 0x65, 0x74, 0x00}
+	reqInfo, err := createRequestInfo(bytes)
+	assert.Nil(t, err)
+	assert.Empty(t, reqInfo.options)
+
+	_, ok := reqInfo.transferSize()
+	assert.False(t, ok)
+}
+
 func TestGetAck(t *testing.T) {
 	bytes := []byte{0x00, 0x01, 0x00, 0x02}
 	block, err := getAck(bytes)
@@ -0,0 +1,231 @@
+package tftputils
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OverlayStorage searches several storages in order for the files read,
+// while files are written to and deleted from a single writable layer.
+// Deleting a file held by the other layers leaves a whiteout hiding it
+// in those layers from then on. Snapshots of WritableLayer keep the
+// whiteouts along with the files written, so they outlive a restart.
+type OverlayStorage struct {
+	layers    []Storage
+	writable  int
+	whiteouts map[string]bool
+	// version changes as whiteouts are added,
+	// on top of the versions of the layers
+	version uint64
+	mutex   *sync.Mutex
+}
+
+// NewOverlayStorage creates an overlay of layers searched in order,
+// writing to the layer at index writable
+func NewOverlayStorage(layers []Storage, writable int) (*OverlayStorage, error) {
+	if writable < 0 || writable >= len(layers) {
+		return nil, fmt.Errorf("No writable layer %v among %v layers", writable, len(layers))
+	}
+	return &OverlayStorage{
+		layers:    layers,
+		writable:  writable,
+		whiteouts: make(map[string]bool),
+		mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// layerFor returns the first layer holding a file that isn't whited out,
+// the layers are queried outside the lock as they may read a disk
+func (ol *OverlayStorage) layerFor(filename string) Storage {
+	whitedOut := ol.whitedOut(filename)
+	for i, layer := range ol.layers {
+		if i != ol.writable && whitedOut {
+			continue
+		}
+		if layer.DoesFileExist(filename) {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (ol *OverlayStorage) Get(filename string) (*FileObject, error) {
+	layer := ol.layerFor(filename)
+	if layer == nil {
+		return nil, fmt.Errorf("%v does not exist", filename)
+	}
+	return layer.Get(filename)
+}
+
+func (ol *OverlayStorage) DoesFileExist(filename string) bool {
+	return ol.layerFor(filename) != nil
+}
+
+// Put writes a file to the writable layer,
+// failing when any layer shows a file with the same name
+func (ol *OverlayStorage) Put(file *FileObject) error {
+	if ol.DoesFileExist(file.filename) {
+		return fmt.Errorf("%v already exists", file.filename)
+	}
+	if err := ol.layers[ol.writable].Put(file); err != nil {
+		return err
+	}
+	ol.whiteOut(file.filename)
+	return nil
+}
+
+// Replace writes a file to the writable layer,
+// hiding the files with the same name of the other layers
+func (ol *OverlayStorage) Replace(file *FileObject) error {
+	if err := ol.layers[ol.writable].Replace(file); err != nil {
+		return err
+	}
+	ol.whiteOut(file.filename)
+	return nil
+}
+
+// Delete removes a file from the writable layer
+// and hides it in the other layers
+func (ol *OverlayStorage) Delete(filename string) error {
+	if !ol.DoesFileExist(filename) {
+		return fmt.Errorf("%v does not exist", filename)
+	}
+	if ol.layers[ol.writable].DoesFileExist(filename) {
+		if err := ol.layers[ol.writable].Delete(filename); err != nil {
+			return err
+		}
+	}
+	ol.whiteOut(filename)
+	return nil
+}
+
+// whiteOut hides a file in the layers other than the
+// writable one, if any of them holds it
+func (ol *OverlayStorage) whiteOut(filename string) {
+	if ol.whitedOut(filename) {
+		return
+	}
+	for i, layer := range ol.layers {
+		if i != ol.writable && layer.DoesFileExist(filename) {
+			ol.addWhiteout(filename)
+			return
+		}
+	}
+}
+
+func (ol *OverlayStorage) whitedOut(filename string) bool {
+	defer ol.mutex.Unlock()
+	ol.mutex.Lock()
+
+	return ol.whiteouts[filename]
+}
+
+func (ol *OverlayStorage) addWhiteout(filename string) {
+	defer ol.mutex.Unlock()
+	ol.mutex.Lock()
+
+	if !ol.whiteouts[filename] {
+		ol.whiteouts[filename] = true
+		ol.version++
+	}
+}
+
+// copyWhiteouts returns the whiteouts and their version,
+// so that the layers are walked without holding the lock
+func (ol *OverlayStorage) copyWhiteouts() (map[string]bool, uint64) {
+	defer ol.mutex.Unlock()
+	ol.mutex.Lock()
+
+	whiteouts := make(map[string]bool, len(ol.whiteouts))
+	for filename := range ol.whiteouts {
+		whiteouts[filename] = true
+	}
+	return whiteouts, ol.version
+}
+
+// Files returns the files every layer shows, sorted by filename
+func (ol *OverlayStorage) Files() []*FileObject {
+	whiteouts, _ := ol.copyWhiteouts()
+	seen := make(map[string]bool)
+	files := []*FileObject{}
+	for i, layer := range ol.layers {
+		for _, file := range layer.Files() {
+			if seen[file.filename] || (i != ol.writable && whiteouts[file.filename]) {
+				continue
+			}
+			seen[file.filename] = true
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].filename < files[j].filename
+	})
+	return files
+}
+
+// SetLimits and CheckQuota apply to the writable layer
+func (ol *OverlayStorage) SetLimits(limits StoreLimits) {
+	ol.layers[ol.writable].SetLimits(limits)
+}
+
+func (ol *OverlayStorage) CheckQuota(size int64) error {
+	return ol.layers[ol.writable].CheckQuota(size)
+}
+
+func (ol *OverlayStorage) Version() uint64 {
+	_, version := ol.copyWhiteouts()
+	for _, layer := range ol.layers {
+		version += layer.Version()
+	}
+	return version
+}
+
+// ReserveRead and ReleaseRead pass reads in progress on to the writable layer
+func (ol *OverlayStorage) ReserveRead(filename string) error {
+	return reserveRead(ol.layers[ol.writable], filename)
+}
+
+func (ol *OverlayStorage) ReleaseRead(filename string) {
+	releaseRead(ol.layers[ol.writable], filename)
+}
+
+// RecordRead passes completed reads on to the writable layer
+func (ol *OverlayStorage) RecordRead(filename string) {
+	recordRead(ol.layers[ol.writable], filename)
+}
+
+// WritableLayer returns the writable layer along with the whiteouts
+// of the overlay, what a snapshot keeps of it
+func (ol *OverlayStorage) WritableLayer() Storage {
+	return &writableLayer{Storage: ol.layers[ol.writable], overlay: ol}
+}
+
+// writableLayer is the writable layer of an overlay whose
+// version also changes as whiteouts are added
+type writableLayer struct {
+	Storage
+	overlay *OverlayStorage
+}
+
+func (wl *writableLayer) Version() uint64 {
+	_, version := wl.overlay.copyWhiteouts()
+	return wl.Storage.Version() + version
+}
+
+// Whiteouts returns the filenames whited out, sorted
+func (wl *writableLayer) Whiteouts() []string {
+	whiteouts, _ := wl.overlay.copyWhiteouts()
+	filenames := []string{}
+	for filename := range whiteouts {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// RestoreWhiteout hides a file of the other layers again,
+// whether they hold it at the moment or not
+func (wl *writableLayer) RestoreWhiteout(filename string) {
+	wl.overlay.addWhiteout(filename)
+}
@@ -0,0 +1,95 @@
+package tftputils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayStorageReads(t *testing.T) {
+	site := NewFileStore()
+	shared := NewFileStore()
+	uploads := NewFileStore()
+	assert.Nil(t, site.Put(NewFileObject("pxelinux.cfg/default", []byte("site"))))
+	assert.Nil(t, shared.Put(NewFileObject("pxelinux.cfg/default", []byte("shared"))))
+	assert.Nil(t, shared.Put(NewFileObject("pxelinux.0", []byte("boot"))))
+	overlay, err := NewOverlayStorage([]Storage{site, shared, uploads}, 2)
+	assert.Nil(t, err)
+
+	file, err := overlay.Get("pxelinux.cfg/default")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), file.Size())
+	assert.True(t, overlay.DoesFileExist("pxelinux.0"))
+	assert.Len(t, overlay.Files(), 2)
+
+	assert.NotNil(t, overlay.Put(NewFileObject("pxelinux.0", []byte("other"))))
+	assert.Nil(t, overlay.Put(NewFileObject("backup.cfg", []byte("cfg"))))
+	assert.True(t, uploads.DoesFileExist("backup.cfg"))
+	assert.Len(t, overlay.Files(), 3)
+
+	_, err = NewOverlayStorage([]Storage{site}, 1)
+	assert.NotNil(t, err)
+}
+
+func TestOverlayStorageWhiteouts(t *testing.T) {
+	site := NewFileStore()
+	uploads := NewFileStore()
+	assert.Nil(t, site.Put(NewFileObject("pxelinux.cfg/default", []byte("site"))))
+	overlay, err := NewOverlayStorage([]Storage{site, uploads}, 1)
+	assert.Nil(t, err)
+	version := overlay.Version()
+
+	// Deleting hides the file of the read-only layer, which is kept
+	assert.Nil(t, overlay.Delete("pxelinux.cfg/default"))
+	assert.False(t, overlay.DoesFileExist("pxelinux.cfg/default"))
+	assert.True(t, site.DoesFileExist("pxelinux.cfg/default"))
+	assert.Empty(t, overlay.Files())
+	assert.NotEqual(t, version, overlay.Version())
+	assert.NotNil(t, overlay.Delete("pxelinux.cfg/default"))
+
+	// A new file takes its place
+	assert.Nil(t, overlay.Put(NewFileObject("pxelinux.cfg/default", []byte("new"))))
+	file, err := overlay.Get("pxelinux.cfg/default")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), file.Size())
+
+	// Replacing a file of a layer above the writable one hides it as well
+	assert.Nil(t, site.Put(NewFileObject("hello.txt", []byte("hello"))))
+	assert.Nil(t, overlay.Replace(NewFileObject("hello.txt", []byte("bye"))))
+	file, err = overlay.Get("hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), file.Size())
+	assert.Nil(t, overlay.Delete("hello.txt"))
+	assert.False(t, overlay.DoesFileExist("hello.txt"))
+}
+
+func TestOverlayStorageSnapshotsWhiteouts(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+	site := NewFileStore()
+	assert.Nil(t, site.Put(NewFileObject("pxelinux.cfg/default", []byte("site"))))
+	assert.Nil(t, site.Put(NewFileObject("pxelinux.0", []byte("boot"))))
+
+	overlay, err := NewOverlayStorage([]Storage{site, NewFileStore()}, 1)
+	assert.Nil(t, err)
+	writable := overlay.WritableLayer()
+	version := writable.Version()
+	assert.Nil(t, overlay.Delete("pxelinux.cfg/default"))
+	assert.NotEqual(t, version, writable.Version())
+	assert.Nil(t, overlay.Put(NewFileObject("backup.cfg", []byte("cfg"))))
+	assert.Nil(t, SaveSnapshot(writable, path))
+
+	// A restart restores the uploads and keeps the deleted file hidden
+	restored, err := NewOverlayStorage([]Storage{site, NewFileStore()}, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, LoadSnapshot(restored.WritableLayer(), path))
+	assert.False(t, restored.DoesFileExist("pxelinux.cfg/default"))
+	assert.True(t, restored.DoesFileExist("pxelinux.0"))
+	assert.True(t, restored.DoesFileExist("backup.cfg"))
+	assert.Len(t, restored.Files(), 2)
+
+	// Stores without whiteouts skip them
+	plain := NewFileStore()
+	assert.Nil(t, LoadSnapshot(plain, path))
+	assert.Len(t, plain.Files(), 1)
+}
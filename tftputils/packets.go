@@ -1,24 +1,47 @@
 package tftputils
 
+import "encoding/binary"
+
 func createAckPacket(block uint16) []byte {
-	blockBytes := uint64ToBytes(uint64(block))
-	return []byte{0x0, 0x4,
-		blockBytes[len(blockBytes)-2], blockBytes[len(blockBytes)-1]}
+	return appendAckPacket(make([]byte, 0, 4), block)
 }
 
 func createDataPacket(block uint16, data []byte) []byte {
-	blockBytes := uint64ToBytes(uint64(block))
-	headerPacket := []byte{0x0, 0x3,
-		blockBytes[len(blockBytes)-2], blockBytes[len(blockBytes)-1]}
-	return append(headerPacket, data...)
+	return appendDataPacket(make([]byte, 0, 4+len(data)), block, data)
 }
 
 func createErrorPacket(errCode uint8, errMessage string) []byte {
-	errCodeBytes := uint64ToBytes(uint64(errCode))
-	messageBytes := []byte(errMessage)
+	packet := make([]byte, 4, 5+len(errMessage))
+	binary.BigEndian.PutUint16(packet, ERROR)
+	binary.BigEndian.PutUint16(packet[2:], uint16(errCode))
+	packet = append(packet, errMessage...)
+	return append(packet, 0)
+}
+
+// createRequestPacket creates a read or write request
+// for a file, with options given as name and value pairs
+func createRequestPacket(opCode uint16, filename string, mode string, options ...string) []byte {
+	packet := make([]byte, 2, 4+len(filename)+len(mode))
+	binary.BigEndian.PutUint16(packet, opCode)
+	for _, field := range append([]string{filename, mode}, options...) {
+		packet = append(packet, field...)
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// appendAckPacket writes an ack packet over buf, reusing its capacity
+func appendAckPacket(buf []byte, block uint16) []byte {
+	buf = append(buf[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buf, ACK)
+	binary.BigEndian.PutUint16(buf[2:], block)
+	return buf
+}
 
-	packet := []byte{0x0, 0x5,
-		errCodeBytes[len(errCodeBytes)-2], errCodeBytes[len(errCodeBytes)-1]}
-	packet = append(packet, messageBytes...)
-	return append(packet, []byte{0}...)
+// appendDataPacket writes a data packet over buf, reusing its capacity
+func appendDataPacket(buf []byte, block uint16, data []byte) []byte {
+	buf = append(buf[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(buf, DATA)
+	binary.BigEndian.PutUint16(buf[2:], block)
+	return append(buf, data...)
 }
@@ -22,3 +22,30 @@ func TestDataPackage(t *testing.T) {
 	packet := createDataPacket(1, []byte(message))
 	assert.Equal(t, packet, []byte{0x00, 0x03, 0x00, 0x01, 0x68, 0x69})
 }
+
+func TestAppendDataPacketReusesBuffer(t *testing.T) {
+	buf := make([]byte, 0, maxPacketSize)
+	packet := appendDataPacket(buf, 258, []byte("hi"))
+	assert.Equal(t, []byte{0x00, 0x03, 0x01, 0x02, 0x68, 0x69}, packet)
+	assert.Equal(t, &buf[:1][0], &packet[0])
+
+	packet = appendAckPacket(packet, 3)
+	assert.Equal(t, []byte{0x00, 0x04, 0x00, 0x03}, packet)
+}
+
+func BenchmarkCreateDataPacket(b *testing.B) {
+	block := make([]byte, SmallestBlockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		createDataPacket(uint16(i), block)
+	}
+}
+
+func BenchmarkAppendDataPacket(b *testing.B) {
+	block := make([]byte, SmallestBlockSize)
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = appendDataPacket(buf, uint16(i), block)
+	}
+}
@@ -0,0 +1,160 @@
+package tftputils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Permission is a bit set of operations allowed on a file
+type Permission uint8
+
+const (
+	ReadPermission Permission = 1 << iota
+	WritePermission
+
+	NoPermission        Permission = 0
+	ReadWritePermission            = ReadPermission | WritePermission
+)
+
+var permissionNames = map[string]Permission{
+	"none": NoPermission,
+	"ro":   ReadPermission,
+	"wo":   WritePermission,
+	"rw":   ReadWritePermission,
+}
+
+func (p Permission) String() string {
+	for name, perm := range permissionNames {
+		if perm == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("Permission(%d)", uint8(p))
+}
+
+// PathRule grants a permission to files matching a glob pattern.
+// A pattern matches a file or any of its parent directories,
+// so "boot/*" covers "boot/pxelinux.cfg/default" as well.
+type PathRule struct {
+	pattern    string
+	permission Permission
+}
+
+// Permissions decides which operations are allowed on a file.
+// ReadOnly and WriteOnly switch off writes or reads globally,
+// path rules are then evaluated in order and the first match wins.
+// Files matching no rule can be both read and written.
+type Permissions struct {
+	ReadOnly  bool
+	WriteOnly bool
+	rules     []*PathRule
+}
+
+func NewPermissions() *Permissions {
+	return &Permissions{
+		rules: []*PathRule{},
+	}
+}
+
+// ParsePathRule parses a rule in the form of "pattern none|ro|wo|rw"
+func ParsePathRule(rule string) (*PathRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Malformed path rule: %q", rule)
+	}
+	if _, err := path.Match(fields[0], ""); err != nil {
+		return nil, fmt.Errorf("Malformed path pattern %v: %v", fields[0], err)
+	}
+	permission, ok := permissionNames[strings.ToLower(fields[1])]
+	if !ok {
+		return nil, fmt.Errorf("Unknown permission: %v", fields[1])
+	}
+	return &PathRule{
+		pattern:    fields[0],
+		permission: permission,
+	}, nil
+}
+
+func (r *PathRule) matches(filename string) bool {
+	return matchesPath(r.pattern, filename)
+}
+
+// cleanFilename returns the name of the file a storage reads
+// for filename: "/boot/./x" and "a/../boot/x" both being "boot/x"
+func cleanFilename(filename string) string {
+	return strings.TrimPrefix(path.Clean("/"+filename), "/")
+}
+
+// matchesPath tells whether a glob pattern matches
+// a file or any of its parent directories, by the cleaned filename
+func matchesPath(pattern string, filename string) bool {
+	name := cleanFilename(filename)
+	for ; name != "" && name != "."; name = path.Dir(name) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PathRule) String() string {
+	return fmt.Sprintf("%v %v", r.pattern, r.permission)
+}
+
+// AddRule parses and appends a path rule to the end of the list
+func (p *Permissions) AddRule(rule string) error {
+	parsed, err := ParsePathRule(rule)
+	if err != nil {
+		return err
+	}
+	p.rules = append(p.rules, parsed)
+	return nil
+}
+
+// Permission returns the operations allowed on a file.
+// A nil Permissions allows everything.
+func (p *Permissions) Permission(filename string) Permission {
+	if p == nil {
+		return ReadWritePermission
+	}
+
+	permission := ReadWritePermission
+	for _, rule := range p.rules {
+		if rule.matches(filename) {
+			permission = rule.permission
+			break
+		}
+	}
+	if p.ReadOnly {
+		permission &^= WritePermission
+	}
+	if p.WriteOnly {
+		permission &^= ReadPermission
+	}
+	return permission
+}
+
+func (p *Permissions) CanRead(filename string) bool {
+	return p.Permission(filename)&ReadPermission != 0
+}
+
+func (p *Permissions) CanWrite(filename string) bool {
+	return p.Permission(filename)&WritePermission != 0
+}
+
+// String and Set let path rules be used as a repeatable command line flag
+func (p *Permissions) String() string {
+	if p == nil {
+		return ""
+	}
+	rules := make([]string, len(p.rules))
+	for i, rule := range p.rules {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (p *Permissions) Set(rule string) error {
+	return p.AddRule(rule)
+}
@@ -0,0 +1,59 @@
+package tftputils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePathRule(t *testing.T) {
+	rule, err := ParsePathRule("boot/* ro")
+	assert.Nil(t, err)
+	assert.Equal(t, "boot/* ro", rule.String())
+
+	_, err = ParsePathRule("boot/* rx")
+	assert.NotNil(t, err)
+
+	_, err = ParsePathRule("boot/[ ro")
+	assert.NotNil(t, err)
+
+	_, err = ParsePathRule("boot/*")
+	assert.NotNil(t, err)
+}
+
+func TestEmptyPermissionsAllow(t *testing.T) {
+	var nilPermissions *Permissions
+	assert.Equal(t, ReadWritePermission, nilPermissions.Permission("hi"))
+	assert.Equal(t, ReadWritePermission, NewPermissions().Permission("hi"))
+}
+
+func TestPathRules(t *testing.T) {
+	permissions := NewPermissions()
+	assert.Nil(t, permissions.Set("configs/* rw"))
+	assert.Nil(t, permissions.Set("boot/* ro"))
+	assert.Nil(t, permissions.Set("* none"))
+
+	assert.True(t, permissions.CanWrite("configs/switch1"))
+	assert.True(t, permissions.CanRead("boot/pxelinux.0"))
+	assert.True(t, permissions.CanRead("boot/pxelinux.cfg/default"))
+	assert.False(t, permissions.CanWrite("boot/pxelinux.cfg/default"))
+	assert.False(t, permissions.CanRead("secret"))
+
+	// Leading slashes and dot segments are ignored
+	assert.False(t, permissions.CanWrite("/boot/secret"))
+	assert.False(t, permissions.CanWrite("//boot/../boot/secret"))
+	assert.True(t, permissions.CanWrite("/configs/switch1"))
+	assert.False(t, permissions.CanRead("/secret"))
+}
+
+func TestGlobalSwitches(t *testing.T) {
+	permissions := NewPermissions()
+	assert.Nil(t, permissions.Set("configs/* rw"))
+
+	permissions.ReadOnly = true
+	assert.Equal(t, ReadPermission, permissions.Permission("configs/switch1"))
+
+	permissions.ReadOnly = false
+	permissions.WriteOnly = true
+	assert.Equal(t, WritePermission, permissions.Permission("configs/switch1"))
+}
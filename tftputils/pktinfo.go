@@ -0,0 +1,171 @@
+package tftputils
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Packet is a datagram received on a listening connection, along with
+// the local address it was sent to when the platform reports it
+// (IP_PKTINFO / IPV6_PKTINFO), so replies can be sent from that address.
+type Packet struct {
+	Data    []byte
+	Remote  *net.UDPAddr
+	Local   *net.UDPAddr
+	ifIndex int
+	buf     *[]byte
+}
+
+// buffer returns the buffer holding the data of the packet
+func (p *Packet) buffer() *[]byte {
+	if p.buf == nil {
+		return &p.Data
+	}
+	return p.buf
+}
+
+// release hands the buffer of the packet back to the pool
+// once nothing refers to its data anymore
+func (p *Packet) release() {
+	putPacketBuffer(p.buf)
+	p.buf = nil
+	p.Data = nil
+}
+
+// localIP returns the local ip the packet was sent to, nil when unknown
+func (p *Packet) localIP() net.IP {
+	if p.Local == nil {
+		return nil
+	}
+	return p.Local.IP
+}
+
+// oobSize fits the control messages of packet info for both families
+const oobSize = 128
+
+// isIPv4Socket determines the family of the socket behind a local address,
+// a wildcard address without an IP is a dual-stack IPv6 socket
+func isIPv4Socket(addr *net.UDPAddr) bool {
+	return addr.IP != nil && addr.IP.To4() != nil
+}
+
+// enablePacketInfo asks the platform to report the destination
+// address and interface of every packet received
+func (udp *UDPUtils) enablePacketInfo() {
+	localAddr := udp.connection.LocalAddr().(*net.UDPAddr)
+	var err error
+	if isIPv4Socket(localAddr) {
+		err = ipv4.NewPacketConn(udp.connection).SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+		udp.family = 4
+	} else {
+		err = ipv6.NewPacketConn(udp.connection).SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+		udp.family = 6
+	}
+	if err != nil {
+		udp.logger.Warnf("Cannot get packet info on %v, replies may come from another address: %v", localAddr, err)
+		udp.family = 0
+		return
+	}
+	udp.oob = make([]byte, oobSize)
+}
+
+// ReadPacket reads the next datagram of a listening connection
+// into a pooled buffer, see Packet.release
+func (udp *UDPUtils) ReadPacket() (*Packet, error) {
+	buf := getPacketBuffer()
+	length, oobLength, _, addr, err := udp.connection.ReadMsgUDP(*buf, udp.oob)
+	if err != nil {
+		putPacketBuffer(buf)
+		udp.logger.Errorf("Cannot read from UDP: %v", err)
+		return nil, err
+	}
+	*buf = (*buf)[:length]
+	packet := &Packet{Data: *buf, Remote: addr, buf: buf}
+	udp.parsePacketInfo(packet, udp.oob[:oobLength])
+	return packet, nil
+}
+
+// parsePacketInfo sets the local address of a packet
+// from the control message it was received with
+func (udp *UDPUtils) parsePacketInfo(packet *Packet, oob []byte) {
+	if udp.family == 0 || len(oob) == 0 {
+		return
+	}
+
+	var dst net.IP
+	var ifIndex int
+	if udp.family == 4 {
+		controlMessage := &ipv4.ControlMessage{}
+		if controlMessage.Parse(oob) == nil {
+			dst, ifIndex = controlMessage.Dst, controlMessage.IfIndex
+		}
+	} else {
+		controlMessage := &ipv6.ControlMessage{}
+		if controlMessage.Parse(oob) == nil {
+			dst, ifIndex = controlMessage.Dst, controlMessage.IfIndex
+		}
+	}
+	if dst != nil {
+		packet.Local = &net.UDPAddr{IP: dst, Zone: linkLocalZone(dst, ifIndex)}
+		packet.ifIndex = ifIndex
+	}
+}
+
+// WriteToAddrFrom writes to a specific address from the local ip
+// a request was received on, a nil ip lets the platform pick one
+func (udp *UDPUtils) WriteToAddrFrom(data []byte, addr *net.UDPAddr, src net.IP, ifIndex int) error {
+	oob := packetInfoFrom(udp.family, src, ifIndex)
+	if oob == nil {
+		return udp.WriteToAddr(data, addr)
+	}
+
+	_, _, err := udp.connection.WriteMsgUDP(data, oob, addr)
+	if err != nil {
+		udp.logger.Errorf("Error writing to udp %v: %v", addr, err)
+		return err
+	}
+	return nil
+}
+
+// packetInfoFrom builds the control message sending a packet
+// from src, nil when the socket doesn't take packet info
+func packetInfoFrom(family int, src net.IP, ifIndex int) []byte {
+	if family == 0 || src == nil {
+		return nil
+	}
+	if family == 4 {
+		return (&ipv4.ControlMessage{Src: src.To4()}).Marshal()
+	}
+	return (&ipv6.ControlMessage{Src: src, IfIndex: ifIndex}).Marshal()
+}
+
+// linkLocalZone returns the name of the interface for link-local
+// addresses, which are ambiguous without it
+func linkLocalZone(ip net.IP, ifIndex int) string {
+	if !ip.IsLinkLocalUnicast() || ip.To4() != nil || ifIndex == 0 {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// hostOf returns an ip with its zone as a host suitable for net.JoinHostPort,
+// IPv4-mapped IPv6 addresses are turned back into plain IPv4 ones.
+// It is empty for a nil or unspecified ip.
+func hostOf(ip net.IP, zone string) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	if zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
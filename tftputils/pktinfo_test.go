@@ -0,0 +1,61 @@
+package tftputils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostOf(t *testing.T) {
+	assert.Equal(t, "", hostOf(nil, ""))
+	assert.Equal(t, "", hostOf(net.IPv4zero, ""))
+	assert.Equal(t, "", hostOf(net.IPv6unspecified, ""))
+	assert.Equal(t, "10.0.0.1", hostOf(net.ParseIP("10.0.0.1"), ""))
+	assert.Equal(t, "10.0.0.1", hostOf(net.ParseIP("::ffff:10.0.0.1"), ""))
+	assert.Equal(t, "2001:db8::1", hostOf(net.ParseIP("2001:db8::1"), ""))
+	assert.Equal(t, "fe80::1%eth0", hostOf(net.ParseIP("fe80::1"), "eth0"))
+}
+
+func TestListenNetwork(t *testing.T) {
+	assert.Equal(t, "udp", listenNetwork(&net.UDPAddr{Port: 69}))
+	assert.Equal(t, "udp4", listenNetwork(&net.UDPAddr{IP: net.IPv4zero, Port: 69}))
+	assert.Equal(t, "udp6", listenNetwork(&net.UDPAddr{IP: net.IPv6unspecified, Port: 69}))
+}
+
+func TestReadPacketLocalAddress(t *testing.T) {
+	listener, err := NewListener("127.0.0.1:0", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.udpUtils.CloseConnection()
+
+	client, err := NewUDPUtils("", listener.udpUtils.LocalAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+
+	message := []byte("hello")
+	assert.Nil(t, client.WriteToConn(message))
+	packet, err := listener.udpUtils.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, message, packet.Data)
+	if assert.NotNil(t, packet.Local) {
+		assert.True(t, packet.Local.IP.Equal(net.ParseIP("127.0.0.1")))
+	}
+	assert.Equal(t, "127.0.0.1", listener.sessionHost(packet))
+
+	assert.Nil(t, sendErrorPacketTo(FileNotFoundErr, "nope", listener.udpUtils, packet))
+	reply, _, err := client.ReadFromConn()
+	assert.Nil(t, err)
+	assert.Equal(t, createErrorPacket(FileNotFoundErr, "nope"), reply)
+}
+
+func TestAddressList(t *testing.T) {
+	var addresses AddressList
+	assert.Nil(t, addresses.Set("0.0.0.0:69"))
+	assert.Nil(t, addresses.Set("[::]:69, [fe80::1%eth0]:69"))
+	assert.Equal(t, AddressList{"0.0.0.0:69", "[::]:69", "[fe80::1%eth0]:69"}, addresses)
+	assert.Equal(t, "0.0.0.0:69,[::]:69,[fe80::1%eth0]:69", addresses.String())
+}
@@ -0,0 +1,89 @@
+package tftputils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortRange hands out the local ports transfers are run on.
+// Ports are handed out round robin so a port just released
+// isn't reused right away, while stray packets may still arrive.
+type PortRange struct {
+	low   int
+	high  int
+	next  int
+	inUse map[int]bool
+	mutex *sync.Mutex
+}
+
+func NewPortRange(low int, high int) (*PortRange, error) {
+	if low < 1 || high > 65535 || low > high {
+		return nil, fmt.Errorf("Invalid port range: %v-%v", low, high)
+	}
+	return &PortRange{
+		low:   low,
+		high:  high,
+		next:  low,
+		inUse: make(map[int]bool),
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+// ParsePortRange parses a range in the form of "low-high"
+func ParsePortRange(portRange string) (*PortRange, error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Malformed port range: %q", portRange)
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed port range %q: %v", portRange, err)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed port range %q: %v", portRange, err)
+	}
+	return NewPortRange(low, high)
+}
+
+// Size returns the number of ports in the range
+func (pr *PortRange) Size() int {
+	return pr.high - pr.low + 1
+}
+
+// Acquire reserves the next free port,
+// it returns false when every port is in use
+func (pr *PortRange) Acquire() (int, bool) {
+	defer pr.mutex.Unlock()
+	pr.mutex.Lock()
+
+	for i := 0; i < pr.Size(); i++ {
+		port := pr.next
+		pr.next++
+		if pr.next > pr.high {
+			pr.next = pr.low
+		}
+		if !pr.inUse[port] {
+			pr.inUse[port] = true
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (pr *PortRange) Release(port int) {
+	defer pr.mutex.Unlock()
+	pr.mutex.Lock()
+
+	delete(pr.inUse, port)
+}
+
+// InUse returns the number of ports currently reserved
+func (pr *PortRange) InUse() int {
+	defer pr.mutex.Unlock()
+	pr.mutex.Lock()
+
+	return len(pr.inUse)
+}
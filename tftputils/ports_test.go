@@ -0,0 +1,99 @@
+package tftputils
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRange(t *testing.T) {
+	ports, err := ParsePortRange("50000-50100")
+	assert.Nil(t, err)
+	assert.Equal(t, 101, ports.Size())
+
+	_, err = ParsePortRange("50000")
+	assert.NotNil(t, err)
+
+	_, err = ParsePortRange("50100-50000")
+	assert.NotNil(t, err)
+
+	_, err = ParsePortRange("0-70000")
+	assert.NotNil(t, err)
+}
+
+func TestPortRangeAcquire(t *testing.T) {
+	ports, err := NewPortRange(50000, 50001)
+	assert.Nil(t, err)
+
+	first, ok := ports.Acquire()
+	assert.True(t, ok)
+	second, ok := ports.Acquire()
+	assert.True(t, ok)
+	assert.NotEqual(t, first, second)
+
+	_, ok = ports.Acquire()
+	assert.False(t, ok)
+	assert.Equal(t, 2, ports.InUse())
+
+	ports.Release(first)
+	port, ok := ports.Acquire()
+	assert.True(t, ok)
+	assert.Equal(t, first, port)
+}
+
+func TestPortRangeRoundRobin(t *testing.T) {
+	ports, err := NewPortRange(50000, 50002)
+	assert.Nil(t, err)
+
+	first, _ := ports.Acquire()
+	ports.Release(first)
+	second, _ := ports.Acquire()
+	assert.NotEqual(t, first, second)
+}
+
+func TestAbandonedTransferReleasesPort(t *testing.T) {
+	config := NewServerConfig()
+	config.TransferPorts = "53200-53200"
+	config.Timeout = 20 * time.Millisecond
+	config.Retries = 1
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(RRQ, "boot/pxelinux.0", OCTET), serverAddr))
+	_, session, err := client.ReadFromConn()
+	assert.Nil(t, err)
+	assert.Equal(t, 53200, session.Port)
+	assert.Equal(t, 1, server.ports.InUse())
+
+	// The client never acks, the only port of the range
+	// comes back once the transfer gives up on it
+	for deadline := time.Now().Add(time.Second); server.ports.InUse() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.ports.InUse())
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, _, err := upstream.Fetch("boot/pxelinux.0")
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "boot", string(data))
+	}
+}
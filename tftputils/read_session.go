@@ -3,26 +3,32 @@ package tftputils
 import (
 	"errors"
 	"fmt"
-	"net"
-
-	"github.com/sirupsen/logrus"
+	"io"
 )
 
 // ReadSession holds necessary info about how to send
 // file data to client.
 type ReadSession struct {
-	udpUtils *UDPUtils
-	file     *FileObject
-	reqInfo  *RequestInfo
-	blockLoc uint16
+	udpUtils    *UDPUtils
+	fileStorage Storage
+	file        *FileObject
+	content     *io.SectionReader
+	reqInfo     *RequestInfo
+	blockLoc    uint16
+	offset      int64
+	lastSent    bool
+	read        bool
+	transfer    *Transfer
 }
 
-func NewReadSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDPAddr) (*ReadSession, error) {
-	udpUtils, err := NewUDPUtils("", remoteAddr.String())
-	if err != nil {
-		return nil, err
+// NewReadSession validates the request and prepares a session
+// talking to the client over udpUtils
+func NewReadSession(fileS Storage, reqInfo *RequestInfo, udpUtils *UDPUtils) (*ReadSession, error) {
+	file, ok, err := validateReadRequest(fileS, reqInfo, udpUtils)
+	if file != nil && (err != nil || !ok) {
+		releaseRead(fileS, reqInfo.filename)
+		file.Close()
 	}
-	ok, err := validateReadRequest(fileS, reqInfo, udpUtils)
 	if err != nil {
 		return nil, err
 	}
@@ -30,39 +36,67 @@ func NewReadSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDPA
 	if !ok {
 		return nil, errors.New("Cannot continue protocol")
 	}
-
-	file, err := fileS.Get(reqInfo.filename)
-	if err != nil {
-		return nil, err
-	}
 	return &ReadSession{
-		udpUtils: udpUtils,
-		file:     file,
-		reqInfo:  reqInfo,
-		blockLoc: 1,
+		udpUtils:    udpUtils,
+		fileStorage: fileS,
+		file:        file,
+		content:     file.NewReader(),
+		reqInfo:     reqInfo,
+		blockLoc:    1,
 	}, nil
 }
 
-// SpawnReadSession dials up to the address provided and
+// SpawnReadSession talks to the client over the connection provided and
 // starts sending necessary bytes to the client to save.
-func SpawnReadSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDPAddr) error {
-	reader, err := NewReadSession(fileS, reqInfo, remoteAddr)
+func SpawnReadSession(
+	fileS Storage,
+	reqInfo *RequestInfo,
+	udpUtils *UDPUtils,
+	transfer *Transfer) (err error) {
+
+	// close connection at the end of session
+	defer udpUtils.CloseConnection()
+
+	var reader *ReadSession
+	record := newAuditRecord(ReadDirection, reqInfo)
+	defer func() {
+		if reader == nil {
+			reqInfo.auditSession(record, transfer, udpUtils, 0, nil, err)
+			return
+		}
+		// The digest is only recorded when known, sending a file
+		// mustn't read it whole once more to checksum it
+		reqInfo.auditSession(record, transfer, udpUtils, reader.offset, func() []byte {
+			digest, _, ok := reader.file.knownChecksums()
+			if !ok {
+				return nil
+			}
+			return digest[:]
+		}, err)
+		if !reader.read {
+			releaseRead(fileS, reqInfo.filename)
+		}
+		reader.file.Close()
+	}()
+
+	reader, err = NewReadSession(fileS, reqInfo, udpUtils)
 	if err != nil {
 		return err
 	}
 
-	// close connection at the end of session
-	defer reader.udpUtils.CloseConnection()
+	reader.transfer = transfer
+	transfer.setSize(reader.file.Size())
+	transfer.onAbort(reader.abort)
 
-	logrus.Infof("R: Starting a reading session for %v in %v mode",
-		reqInfo.filename, reqInfo.mode)
+	reqInfo.log().Infof("Starting a reading session for %v in %v mode to %v",
+		reqInfo.filename, reqInfo.mode, reqInfo.remote)
 
 	// send first set of data for the client
 	// to be acked
 	reader.sendData()
 
 	for {
-		data, _, err := reader.udpUtils.ReadFromConn()
+		data, err := reader.udpUtils.readFromClient()
 		if err != nil {
 			return err
 		}
@@ -71,21 +105,38 @@ func SpawnReadSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UD
 			return err
 		}
 		if done {
-			logrus.Infof("R: Done transferring data from server to %v", reqInfo.filename)
+			reqInfo.log().Infof("Done transferring data from server to %v", reqInfo.filename)
 			return nil
 		}
 	}
 }
 
-// validateReadRequest validates if a file exists in the server
-// and the mode is supported, otherwise send an error message to the client.
-func validateReadRequest(fileS *FileStore, reqInfo *RequestInfo, udpUtils *UDPUtils) (bool, error) {
-	if !fileS.DoesFileExist(reqInfo.filename) {
-		msg := fmt.Sprintf("R: File %v does not exist in the server", reqInfo.filename)
-		logrus.Error(msg)
-		return false, sendErrorPacket(FileNotFoundErr, msg, udpUtils)
+// validateReadRequest gets the requested file and validates the mode
+// is supported, otherwise send an error message to the client.
+// The file is got first as a storage may find files it doesn't hold,
+// such as from an upstream server. A read of the file returned is
+// reserved, the caller releases it unless the file is read to the end.
+func validateReadRequest(fileS Storage, reqInfo *RequestInfo, udpUtils *UDPUtils) (*FileObject, bool, error) {
+	file, err := fileS.Get(reqInfo.filename)
+	if err != nil && !fileS.DoesFileExist(reqInfo.filename) {
+		msg := fmt.Sprintf("File %v does not exist in the server", reqInfo.filename)
+		reqInfo.log().Errorf("%v: %v", msg, err)
+		return nil, false, sendErrorPacket(FileNotFoundErr, msg, udpUtils)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Cannot read %v: %v", reqInfo.filename, err)
+		reqInfo.log().Errorf("%v", msg)
+		sendErrorPacket(UnknownErr, msg, udpUtils)
+		return nil, false, err
 	}
-	return validateModeAndNotify(reqInfo.mode, udpUtils)
+	if err := reserveRead(fileS, reqInfo.filename); err != nil {
+		file.Close()
+		msg := fmt.Sprintf("File %v does not exist in the server", reqInfo.filename)
+		reqInfo.log().Errorf("%v: %v", msg, err)
+		return nil, false, sendErrorPacket(FileNotFoundErr, msg, udpUtils)
+	}
+	ok, err := validateModeAndNotify(reqInfo.mode, udpUtils, reqInfo.log())
+	return file, ok, err
 }
 
 // ResolvePacket determines from initial request info
@@ -100,13 +151,13 @@ func (rs *ReadSession) ResolvePacket(packet []byte) (bool, error) {
 	case ACK:
 		return rs.handleAck(packet)
 	case ERROR:
-		err := handleError(packet)
+		err := handleError(packet, rs.udpUtils, rs.reqInfo.log())
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	default:
-		return false, fmt.Errorf("R: Opcode unknown or currently unsupported: %v", opCode)
+		return false, fmt.Errorf("Opcode unknown or currently unsupported: %v", opCode)
 	}
 }
 
@@ -117,31 +168,58 @@ func (rs *ReadSession) handleAck(packet []byte) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	// Block numbers roll over to zero past 65535,
+	// as most clients expect for files over 32 MB
 	if blockFromClient == rs.blockLoc {
 		rs.blockLoc++
+	} else if blockFromClient == rs.blockLoc-1 {
+		// The ack of a block sent again is ignored, answering it
+		// would send every following block twice (the Sorcerer's
+		// Apprentice bug of RFC 1123)
+		return false, nil
 	} else {
-		return false, fmt.Errorf("R: Wrong expected byte, actual: %v, expected: %v", blockFromClient, rs.blockLoc)
+		return false, fmt.Errorf("Wrong expected byte, actual: %v, expected: %v", blockFromClient, rs.blockLoc)
 	}
 	return rs.sendData()
 }
 
 // sendData sends data to the client block by block
 // returns a done flag and an error object
-// done flag is true when there is no more data to send
+// done flag is true when there is no more data to send.
+// The block is read straight into the send buffer of the connection.
 func (rs *ReadSession) sendData() (bool, error) {
-	nextBlock := rs.blockLoc * SmallestBlockSize
-	prevBlock := (rs.blockLoc - 1) * SmallestBlockSize
-	dataLen := uint16(len(rs.file.data))
-
-	if prevBlock > dataLen {
+	if rs.lastSent {
+		// The last block was acked, the file was read to the end
+		recordRead(rs.fileStorage, rs.reqInfo.filename)
+		rs.read = true
 		return true, nil
 	}
 
-	var blockData []byte
-	if dataLen < nextBlock {
-		blockData = rs.file.data[prevBlock:]
-	} else {
-		blockData = rs.file.data[prevBlock:nextBlock]
+	packet := appendDataPacket(rs.udpUtils.sendBuffer(), rs.blockLoc, nil)
+	if cap(packet) < len(packet)+SmallestBlockSize {
+		packet = append(make([]byte, 0, len(packet)+SmallestBlockSize), packet...)
 	}
-	return false, sendDataPacket(rs.blockLoc, blockData, rs.udpUtils)
+	block := packet[len(packet) : len(packet)+SmallestBlockSize]
+
+	n, err := rs.content.ReadAt(block, rs.offset)
+	if err != nil && err != io.EOF {
+		msg := fmt.Sprintf("Cannot read %v: %v", rs.reqInfo.filename, err)
+		rs.reqInfo.log().Errorf("%v", msg)
+		sendErrorPacket(UnknownErr, msg, rs.udpUtils)
+		return false, err
+	}
+	// A block shorter than a full one, even empty, ends the transfer
+	if n < SmallestBlockSize {
+		rs.lastSent = true
+	}
+	rs.offset += int64(n)
+	rs.transfer.setTransferred(rs.offset)
+	return false, rs.udpUtils.send(packet[:len(packet)+n])
+}
+
+// abort tells the client the transfer is over and closes
+// the connection, which ends the session loop
+func (rs *ReadSession) abort() {
+	sendErrorPacket(UnknownErr, "Transfer aborted by the server", rs.udpUtils)
+	rs.udpUtils.CloseConnection()
 }
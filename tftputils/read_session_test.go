@@ -0,0 +1,185 @@
+package tftputils
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readFromSession acks every data block the session sends
+// and returns the content received
+func readFromSession(t *testing.T, client *UDPUtils) []byte {
+	var content bytes.Buffer
+	for {
+		packet, addr, err := client.ReadFromConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opCode, _ := getOpCode(packet)
+		if !assert.Equal(t, uint16(DATA), opCode) {
+			return content.Bytes()
+		}
+		block, _ := getAck(packet)
+		data, _ := getData(packet)
+		content.Write(data)
+		client.WriteToAddr(createAckPacket(block), addr)
+		if len(data) < SmallestBlockSize {
+			return content.Bytes()
+		}
+	}
+}
+
+func TestReadSessionServesReaderAt(t *testing.T) {
+	for _, size := range []int{0, 100, SmallestBlockSize, 3*SmallestBlockSize + 17} {
+		data := bytes.Repeat([]byte{0x42}, size)
+		fileStorage := NewFileStore()
+		assert.Nil(t, fileStorage.Put(NewFileObjectReaderAt("image.iso", bytes.NewReader(data), int64(size))))
+
+		client, err := NewUDPUtils("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := NewUDPUtils("", client.LocalAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqInfo := &RequestInfo{filename: "image.iso", mode: OCTET}
+		done := make(chan error)
+		go func() {
+			done <- SpawnReadSession(fileStorage, reqInfo, session, nil)
+		}()
+		assert.Equal(t, string(data), string(readFromSession(t, client)))
+		assert.Nil(t, <-done)
+		client.CloseConnection()
+	}
+}
+
+// zeroReaderAt reads zeros, standing in for a large file
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestReadSessionBlockRollover(t *testing.T) {
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	session, err := NewUDPUtils("", client.LocalAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.CloseConnection()
+
+	// Start right before block 65535 of a file too large for 16 bit offsets
+	size := int64(65536)*SmallestBlockSize + 10
+	file := NewFileObjectReaderAt("big.iso", zeroReaderAt{}, size)
+	reader := &ReadSession{
+		udpUtils: session,
+		file:     file,
+		content:  file.NewReader(),
+		reqInfo:  &RequestInfo{filename: "big.iso", mode: OCTET},
+		blockLoc: 65535,
+		offset:   65534 * SmallestBlockSize,
+	}
+
+	done, err := reader.sendData()
+	assert.False(t, done)
+	assert.Nil(t, err)
+	packet, _, _ := client.ReadFromConn()
+	block, _ := getAck(packet)
+	assert.Equal(t, uint16(65535), block)
+	assert.Len(t, packet, 4+SmallestBlockSize)
+
+	done, err = reader.handleAck(createAckPacket(65535))
+	assert.False(t, done)
+	assert.Nil(t, err)
+	packet, _, _ = client.ReadFromConn()
+	block, _ = getAck(packet)
+	assert.Equal(t, uint16(0), block)
+	assert.Len(t, packet, 4+SmallestBlockSize)
+
+	done, err = reader.handleAck(createAckPacket(0))
+	assert.False(t, done)
+	assert.Nil(t, err)
+	packet, _, _ = client.ReadFromConn()
+	assert.Len(t, packet, 4+10)
+
+	done, err = reader.handleAck(createAckPacket(1))
+	assert.True(t, done)
+	assert.Nil(t, err)
+}
+
+func TestReadSessionRetransmits(t *testing.T) {
+	fileStorage := NewFileStore()
+	assert.Nil(t, fileStorage.Put(NewFileObject("config.txt", []byte("hello"))))
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	session, err := NewUDPUtils("", client.LocalAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetTimeout(50*time.Millisecond, 2)
+
+	done := make(chan error)
+	go func() {
+		done <- SpawnReadSession(fileStorage, &RequestInfo{filename: "config.txt", mode: OCTET}, session, nil)
+	}()
+
+	// The block is sent again until the client answers, the ack
+	// of the block sent again being ignored
+	for i := 0; i < 2; i++ {
+		packet, _, err := client.ReadFromConn()
+		assert.Nil(t, err)
+		assert.Equal(t, createDataPacket(1, []byte("hello")), packet)
+	}
+	client.WriteToAddr(createAckPacket(1), session.connection.LocalAddr().(*net.UDPAddr))
+	client.WriteToAddr(createAckPacket(1), session.connection.LocalAddr().(*net.UDPAddr))
+	assert.Nil(t, <-done)
+}
+
+func TestReadSessionTimesOut(t *testing.T) {
+	fileStorage := NewFileStore()
+	assert.Nil(t, fileStorage.Put(NewFileObject("config.txt", []byte("hello"))))
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	session, err := NewUDPUtils("", client.LocalAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetTimeout(20*time.Millisecond, 2)
+
+	done := make(chan error)
+	go func() {
+		done <- SpawnReadSession(fileStorage, &RequestInfo{filename: "config.txt", mode: OCTET}, session, nil)
+	}()
+
+	// The client never acks, the block is sent three times in all
+	// before the session gives up and tells the client
+	for i := 0; i < 3; i++ {
+		packet, _, err := client.ReadFromConn()
+		assert.Nil(t, err)
+		opCode, _ := getOpCode(packet)
+		assert.Equal(t, uint16(DATA), opCode)
+	}
+	packet, _, err := client.ReadFromConn()
+	assert.Nil(t, err)
+	opCode, _ := getOpCode(packet)
+	assert.Equal(t, uint16(ERROR), opCode)
+	assert.NotNil(t, <-done)
+}
@@ -0,0 +1,298 @@
+package tftputils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// foldIndexMaxAge bounds how long files added behind the back
+// of a storage, such as to a root directory, go unnoticed
+// by the case insensitive lookup
+const foldIndexMaxAge = 10 * time.Second
+
+// backreference matches the \0 to \9 references of tftpd-hpa replacements
+var backreference = regexp.MustCompile(`\\([0-9])`)
+
+// expandClient replaces the \i, \x and \p escapes of a replacement
+// with the IP address, the IP address in uppercase hex and the port
+// of the client, or with nothing when the client isn't known
+func expandClient(template string, remote *net.UDPAddr) string {
+	if !strings.Contains(template, "\\") {
+		return template
+	}
+	var ip, hexIP, port string
+	if remote != nil {
+		ip = remote.IP.String()
+		if ip4 := remote.IP.To4(); ip4 != nil {
+			hexIP = fmt.Sprintf("%X", []byte(ip4))
+		} else {
+			hexIP = fmt.Sprintf("%X", []byte(remote.IP))
+		}
+		port = fmt.Sprint(remote.Port)
+	}
+	return strings.NewReplacer("\\i", ip, "\\x", hexIP, "\\p", port).Replace(template)
+}
+
+// RewriteRule rewrites the filenames matching a regular expression,
+// in the spirit of the remap files of tftpd-hpa. Its flags are
+//
+//	r  rewrite the first match with the replacement, $1 or \1 for groups,
+//	   \i, \x and \p for the IP address, hex IP address and port of the client
+//	g  rewrite every match instead of the first one
+//	i  match case insensitively
+//	e  stop at this rule when it matches
+//	a  refuse the request when it matches
+//	G  only apply to read requests
+//	P  only apply to write requests
+type RewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+	end         bool
+	abort       bool
+	opCode      uint16
+	rule        string
+}
+
+// errRequestRefused is returned for requests matching an abort rule
+var errRequestRefused = errors.New("Request refused by a rewrite rule")
+
+// ParseRewriteRule parses a rule in the form of "flags regex [replacement]"
+func ParseRewriteRule(rule string) (*RewriteRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("Malformed rewrite rule: %q", rule)
+	}
+
+	parsed := &RewriteRule{rule: strings.Join(fields, " ")}
+	expression := fields[1]
+	rewrite := false
+	for _, flag := range fields[0] {
+		switch flag {
+		case 'r':
+			rewrite = true
+		case 'g':
+			parsed.global = true
+		case 'i':
+			expression = "(?i)" + expression
+		case 'e':
+			parsed.end = true
+		case 'a':
+			parsed.abort = true
+		case 'G':
+			parsed.opCode = RRQ
+		case 'P':
+			parsed.opCode = WRQ
+		default:
+			return nil, fmt.Errorf("Unknown rewrite flag %q in %q", flag, rule)
+		}
+	}
+	if rewrite == parsed.abort {
+		return nil, fmt.Errorf("Rewrite rule %q must either rewrite (r) or refuse (a)", rule)
+	}
+	if rewrite != (len(fields) == 3) {
+		return nil, fmt.Errorf("Malformed rewrite rule: %q", rule)
+	}
+	if rewrite {
+		parsed.replacement = backreference.ReplaceAllString(fields[2], "$${$1}")
+	}
+
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed rewrite pattern %v: %v", fields[1], err)
+	}
+	parsed.pattern = pattern
+	return parsed, nil
+}
+
+// apply rewrites a filename requested by remote if the rule matches it
+func (r *RewriteRule) apply(filename string, remote *net.UDPAddr) (string, bool) {
+	match := r.pattern.FindStringSubmatchIndex(filename)
+	if match == nil {
+		return filename, false
+	}
+	replacement := expandClient(r.replacement, remote)
+	if r.global {
+		return r.pattern.ReplaceAllString(filename, replacement), true
+	}
+	replaced := r.pattern.ExpandString(nil, replacement, filename, match)
+	return filename[:match[0]] + string(replaced) + filename[match[1]:], true
+}
+
+func (r *RewriteRule) String() string {
+	return r.rule
+}
+
+// Rewriter maps the filenames clients request to the filenames stored.
+// The filename is first normalized, then looked up in the aliases,
+// then rewritten by every rule in order.
+type Rewriter struct {
+	// Backslashes turns backslashes into slashes,
+	// for clients sending Windows paths such as "\boot\bcd"
+	Backslashes bool
+	// StripLeadingSlash removes the slashes filenames start with
+	StripLeadingSlash bool
+	// CaseInsensitive serves a file whose name only differs
+	// in case when no file has the exact name requested
+	CaseInsensitive bool
+
+	aliases map[string]string
+	rules   []*RewriteRule
+}
+
+func NewRewriter() *Rewriter {
+	return &Rewriter{
+		aliases: make(map[string]string),
+		rules:   []*RewriteRule{},
+	}
+}
+
+// AddRule parses and appends a rewrite rule to the end of the list
+func (rw *Rewriter) AddRule(rule string) error {
+	parsed, err := ParseRewriteRule(rule)
+	if err != nil {
+		return err
+	}
+	rw.rules = append(rw.rules, parsed)
+	return nil
+}
+
+// AddAlias parses an alias in the form of "name target",
+// requests for name being served target, in which \i, \x and \p
+// stand for the client as in the replacements of rules
+func (rw *Rewriter) AddAlias(alias string) error {
+	fields := strings.Fields(alias)
+	if len(fields) != 2 {
+		return fmt.Errorf("Malformed alias: %q", alias)
+	}
+	rw.aliases[fields[0]] = fields[1]
+	return nil
+}
+
+// LoadRules reads the rules of a file holding one per line, aliases
+// being given as "alias name target". Empty lines and lines starting
+// with # are skipped.
+func (rw *Rewriter) LoadRules(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rw.Set(line); err != nil {
+			return fmt.Errorf("%v:%v: %v", path, number, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Rewrite returns the filename to serve for a read or write request
+// from remote. A nil Rewriter leaves filenames as they are.
+func (rw *Rewriter) Rewrite(filename string, opCode uint16, remote *net.UDPAddr) (string, error) {
+	if rw == nil {
+		return filename, nil
+	}
+	if rw.Backslashes {
+		filename = strings.Replace(filename, "\\", "/", -1)
+	}
+	if rw.StripLeadingSlash {
+		filename = strings.TrimLeft(filename, "/")
+	}
+	if target, ok := rw.aliases[filename]; ok {
+		filename = expandClient(target, remote)
+	}
+
+	for _, rule := range rw.rules {
+		if rule.opCode != UNKNOWNOP && rule.opCode != opCode {
+			continue
+		}
+		rewritten, matched := rule.apply(filename, remote)
+		if !matched {
+			continue
+		}
+		if rule.abort {
+			return filename, errRequestRefused
+		}
+		filename = rewritten
+		if rule.end {
+			break
+		}
+	}
+	return filename, nil
+}
+
+// foldIndex finds the stored files whose name only differs in case,
+// by their lowercased names. The storage is listed again once its
+// version changed or the index got older than foldIndexMaxAge.
+type foldIndex struct {
+	storage Storage
+	names   map[string]string
+	version uint64
+	built   time.Time
+	mutex   *sync.Mutex
+}
+
+func newFoldIndex(storage Storage) *foldIndex {
+	return &foldIndex{
+		storage: storage,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// find returns the name of a stored file equal to
+// filename under case folding, if there is one
+func (fi *foldIndex) find(filename string) (string, bool) {
+	defer fi.mutex.Unlock()
+	fi.mutex.Lock()
+
+	version := fi.storage.Version()
+	if fi.names == nil || version != fi.version || time.Since(fi.built) > foldIndexMaxAge {
+		fi.names = make(map[string]string)
+		for _, file := range fi.storage.Files() {
+			lowered := strings.ToLower(file.filename)
+			if _, ok := fi.names[lowered]; !ok {
+				fi.names[lowered] = file.filename
+			}
+		}
+		fi.version = version
+		fi.built = time.Now()
+	}
+	name, ok := fi.names[strings.ToLower(filename)]
+	return name, ok
+}
+
+// String and Set let rewrite rules be used as a repeatable command line flag
+func (rw *Rewriter) String() string {
+	if rw == nil {
+		return ""
+	}
+	rules := make([]string, len(rw.rules))
+	for i, rule := range rw.rules {
+		rules[i] = rule.String()
+	}
+	for name, target := range rw.aliases {
+		rules = append(rules, fmt.Sprintf("alias %v %v", name, target))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Set adds a rule, or an alias given as "alias name target"
+func (rw *Rewriter) Set(rule string) error {
+	if strings.HasPrefix(rule, "alias ") {
+		return rw.AddAlias(strings.TrimPrefix(rule, "alias "))
+	}
+	return rw.AddRule(rule)
+}
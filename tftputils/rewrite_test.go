@@ -0,0 +1,197 @@
+package tftputils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	rule, err := ParseRewriteRule("r   ^/tftpboot/(.*)  \\1")
+	assert.Nil(t, err)
+	assert.Equal(t, "r ^/tftpboot/(.*) \\1", rule.String())
+
+	for _, malformed := range []string{
+		"r ^/boot", "a ^/boot target", "x ^/boot target", "ra ^/boot target",
+		"g ^/boot target", "r ( target", "r", "r a b c",
+	} {
+		_, err = ParseRewriteRule(malformed)
+		assert.NotNil(t, err, malformed)
+	}
+}
+
+func TestRewriteRuleApply(t *testing.T) {
+	rule, err := ParseRewriteRule("r ^/tftpboot/(.*) \\1")
+	assert.Nil(t, err)
+	rewritten, matched := rule.apply("/tftpboot/pxelinux.0", nil)
+	assert.True(t, matched)
+	assert.Equal(t, "pxelinux.0", rewritten)
+	_, matched = rule.apply("pxelinux.0", nil)
+	assert.False(t, matched)
+
+	rule, err = ParseRewriteRule("r (x86)_(64) ${2}bit")
+	assert.Nil(t, err)
+	rewritten, _ = rule.apply("boot/x86_64/kernel", nil)
+	assert.Equal(t, "boot/64bit/kernel", rewritten)
+
+	// Only the first match is rewritten without the g flag
+	rule, err = ParseRewriteRule("r a b")
+	assert.Nil(t, err)
+	rewritten, _ = rule.apply("banana", nil)
+	assert.Equal(t, "bbnana", rewritten)
+	rule, err = ParseRewriteRule("rg a b")
+	assert.Nil(t, err)
+	rewritten, _ = rule.apply("banana", nil)
+	assert.Equal(t, "bbnbnb", rewritten)
+
+	rule, err = ParseRewriteRule("ri ^BOOT/ boot/")
+	assert.Nil(t, err)
+	rewritten, _ = rule.apply("Boot/bcd", nil)
+	assert.Equal(t, "boot/bcd", rewritten)
+}
+
+func TestRewriterRules(t *testing.T) {
+	rw := NewRewriter()
+	assert.Nil(t, rw.Set("re ^pxelinux.cfg/01-(.*) pxelinux.cfg/default"))
+	assert.Nil(t, rw.Set("r ^pxelinux.cfg/ cfg/"))
+	assert.Nil(t, rw.Set("rG \\.img$ .img.gz"))
+	assert.Nil(t, rw.Set("aP ^firmware/"))
+
+	// The e flag stops at the first rule
+	name, err := rw.Rewrite("pxelinux.cfg/01-aa-bb", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "pxelinux.cfg/default", name)
+	name, err = rw.Rewrite("pxelinux.cfg/menu", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "cfg/menu", name)
+
+	// G and P rules only apply to reads and writes respectively
+	name, err = rw.Rewrite("root.img", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "root.img.gz", name)
+	name, err = rw.Rewrite("root.img", WRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "root.img", name)
+
+	_, err = rw.Rewrite("firmware/bios.bin", WRQ, nil)
+	assert.Equal(t, errRequestRefused, err)
+	name, err = rw.Rewrite("firmware/bios.bin", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "firmware/bios.bin", name)
+}
+
+func TestRewriterNormalization(t *testing.T) {
+	rw := NewRewriter()
+	rw.Backslashes = true
+	rw.StripLeadingSlash = true
+	assert.Nil(t, rw.Set("alias boot/bcd windows/bcd"))
+
+	name, err := rw.Rewrite("\\boot\\bcd", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "windows/bcd", name)
+	name, err = rw.Rewrite("//boot/wim", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "boot/wim", name)
+
+	assert.NotNil(t, rw.Set("alias boot/bcd"))
+	assert.Equal(t, "alias boot/bcd windows/bcd", rw.String())
+
+	var nilRewriter *Rewriter
+	name, err = nilRewriter.Rewrite("\\boot\\bcd", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "\\boot\\bcd", name)
+}
+
+func TestRewriterLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "remap")
+	rules := "# PXE clients\n\nr ^/tftpboot/ \nalias grub.efi efi/grubx64.efi\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(rules), 0644))
+	assert.NotNil(t, NewRewriter().LoadRules(path))
+
+	rules = "# PXE clients\n\nr ^/tftpboot/(.*) \\1\nalias grub.efi efi/grubx64.efi\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(rules), 0644))
+	rw := NewRewriter()
+	assert.Nil(t, rw.LoadRules(path))
+	name, err := rw.Rewrite("/tftpboot/grub.efi", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "grub.efi", name)
+	name, err = rw.Rewrite("grub.efi", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "efi/grubx64.efi", name)
+
+	assert.NotNil(t, rw.LoadRules(filepath.Join(dir, "missing")))
+}
+
+func TestFoldIndex(t *testing.T) {
+	store := &countingFilesStorage{Storage: NewFileStore()}
+	assert.Nil(t, store.Put(NewFileObject("Boot/BCD", []byte("bcd"))))
+	folds := newFoldIndex(store)
+
+	name, ok := folds.find("boot/bcd")
+	assert.True(t, ok)
+	assert.Equal(t, "Boot/BCD", name)
+	_, ok = folds.find("boot/wim")
+	assert.False(t, ok)
+	// The storage is only listed again once it changed
+	assert.Equal(t, 1, store.listings)
+
+	assert.Nil(t, store.Put(NewFileObject("Boot/WIM", []byte("wim"))))
+	name, ok = folds.find("boot/wim")
+	assert.True(t, ok)
+	assert.Equal(t, "Boot/WIM", name)
+	assert.Equal(t, 2, store.listings)
+}
+
+// countingFilesStorage counts the listings of a storage
+type countingFilesStorage struct {
+	Storage
+	listings int
+}
+
+func (c *countingFilesStorage) Files() []*FileObject {
+	c.listings++
+	return c.Storage.Files()
+}
+
+func TestRewriterClientTemplates(t *testing.T) {
+	rw := NewRewriter()
+	assert.Nil(t, rw.Set("alias config.txt configs/\\i/config.txt"))
+	assert.Nil(t, rw.Set("r ^pxelinux.cfg/default$ pxelinux.cfg/\\x"))
+	assert.Nil(t, rw.Set("r ^(log)$ \\1-\\p.txt"))
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.3.17"), Port: 2048}
+	name, err := rw.Rewrite("config.txt", RRQ, client)
+	assert.Nil(t, err)
+	assert.Equal(t, "configs/10.0.3.17/config.txt", name)
+	name, err = rw.Rewrite("pxelinux.cfg/default", RRQ, client)
+	assert.Nil(t, err)
+	assert.Equal(t, "pxelinux.cfg/0A000311", name)
+	name, err = rw.Rewrite("log", WRQ, client)
+	assert.Nil(t, err)
+	assert.Equal(t, "log-2048.txt", name)
+
+	name, err = rw.Rewrite("config.txt", RRQ, &net.UDPAddr{IP: net.ParseIP("fd00::1")})
+	assert.Nil(t, err)
+	assert.Equal(t, "configs/fd00::1/config.txt", name)
+	name, err = rw.Rewrite("config.txt", RRQ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "configs//config.txt", name)
+}
+
+func TestRequestInfoExpand(t *testing.T) {
+	reqInfo := &RequestInfo{
+		filename: "config.txt",
+		remote:   &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 69},
+	}
+	assert.Equal(t, "fd00::1", reqInfo.Remote().IP.String())
+	assert.Equal(t, "FD000000000000000000000000000001/69", reqInfo.Expand("\\x/\\p"))
+	assert.Equal(t, "plain", reqInfo.Expand("plain"))
+}
@@ -3,101 +3,681 @@ package tftputils
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-	"github.com/sirupsen/logrus"
+const (
+	// defaultTimeout and defaultRetries are how long and how many times
+	// a transfer waits for a silent client when they aren't configured
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 5
+	// defaultShutdownTimeout is how long a shutdown waits
+	// for the running transfers before aborting them
+	defaultShutdownTimeout = 10 * time.Second
 )
 
-type SpawnerFunction func(*FileStore, *RequestInfo, *net.UDPAddr) error
+type SpawnerFunction func(Storage, *RequestInfo, *UDPUtils, *Transfer) error
 
-// ServeSession holds the udp read/write utils
-// and a file storage reference
+// ServeSession holds the udp read/write utils,
+// a file storage reference and the limiters guarding it
 type ServeSession struct {
-	udpUtils    *UDPUtils
-	fileStorage *FileStore
+	listeners      []*Listener
+	fileStorage    Storage
+	folds          *foldIndex
+	config         *ServerConfig
+	requestLimiter *RequestLimiter
+	sessionLimiter *SessionLimiter
+	snapshotter    *Snapshotter
+	expiring       *ExpiringStorage
+	transfers      *TransferRegistry
+	httpServers    []*http.Server
+	ports          *PortRange
+	logger         Logger
+	closing        int32
+	// sessions counts the running sessions a shutdown waits for,
+	// mutex keeps sessions from starting once it began
+	sessions *sync.WaitGroup
+	mutex    *sync.Mutex
 }
 
 // SpawnServeSession reads from socket and resolve the initial request from client
 // and spawn a server in the main goroutine
-func SpawnServeSession() error {
-	server, err := NewServeSession()
+func SpawnServeSession(config *ServerConfig) error {
+	server, err := NewServeSession(config)
 	if err != nil {
 		return err
 	}
-	defer server.udpUtils.CloseConnection()
+	return server.Serve()
+}
 
-	for {
-		data, addr, err := server.udpUtils.ReadFromConn()
+// Serve reads from every listening socket and resolves the initial requests
+// from clients until an error occurs or the server is shut down
+func (s *ServeSession) Serve() error {
+	defer s.closeListeners()
+
+	for _, httpServer := range s.httpServers {
+		if err := listenHTTP(httpServer, s.logger); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, len(s.listeners))
+	for _, listener := range s.listeners {
+		go func(listener *Listener) {
+			errs <- s.serveListener(listener)
+		}(listener)
+	}
+
+	// Any listener failing brings the whole server down
+	for range s.listeners {
+		err := <-errs
 		if err != nil {
 			return err
 		}
-		_, err = server.ResolvePacket(data, addr)
+	}
+	return nil
+}
+
+func (s *ServeSession) serveListener(listener *Listener) error {
+	for {
+		packets, err := listener.readPackets()
 		if err != nil {
+			if atomic.LoadInt32(&s.closing) != 0 {
+				return nil
+			}
 			return err
 		}
+		for _, packet := range packets {
+			if listener.mux != nil && listener.mux.Dispatch(packet) {
+				continue
+			}
+			// A packet that can't be handled is dropped,
+			// only the socket failing ends the listener
+			_, err = s.ResolvePacket(listener, packet)
+			packet.release()
+			if err != nil {
+				s.logger.WithFields(Fields{"client": packet.Remote.String()}).Warnf("Dropping packet: %v", err)
+			}
+		}
 	}
 }
 
-func NewServeSession() (*ServeSession, error) {
-	udpUtils, err := NewUDPUtils("", "")
+// LocalAddresses returns the addresses the server listens on
+func (s *ServeSession) LocalAddresses() []string {
+	addresses := make([]string, len(s.listeners))
+	for i, listener := range s.listeners {
+		addresses[i] = listener.udpUtils.LocalAddress()
+	}
+	return addresses
+}
+
+func (s *ServeSession) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.udpUtils.CloseConnection()
+	}
+}
+
+// listenHTTP binds the address of an HTTP server
+// and serves it in a new goroutine
+func listenHTTP(httpServer *http.Server, logger Logger) error {
+	listener, err := net.Listen("tcp", httpServer.Addr)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	logger.Infof("Listening HTTP at %v", listener.Addr())
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Errorf("%v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the server from accepting new requests, waits for
+// the running transfers to end, aborting those still running after
+// the shutdown timeout, then stops deleting expired files, saves the
+// file storage snapshot, if any, and closes the audit sink, if any
+func (s *ServeSession) Shutdown() error {
+	s.mutex.Lock()
+	atomic.StoreInt32(&s.closing, 1)
+	s.mutex.Unlock()
+
+	for _, httpServer := range s.httpServers {
+		httpServer.Close()
+	}
+	// Multiplexed sessions run over the listening sockets,
+	// those are only closed once the sessions are over
+	for _, listener := range s.listeners {
+		if listener.mux == nil {
+			listener.udpUtils.CloseConnection()
+		}
+	}
+	s.drainSessions()
+	s.closeListeners()
+
+	s.expiring.Stop()
+	var err error
+	if s.snapshotter != nil {
+		err = s.snapshotter.Stop()
+	}
+	if s.config.Audit != nil {
+		if auditErr := s.config.Audit.Close(); err == nil {
+			err = auditErr
+		}
+	}
+	return err
+}
+
+// drainSessions waits for the running sessions to end,
+// aborting those still running after the shutdown timeout
+func (s *ServeSession) drainSessions() {
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+
+	timeout := s.config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
 	}
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	transfers := s.transfers.List()
+	s.logger.Warnf("Aborting the %v transfers still running", len(transfers))
+	for _, transfer := range transfers {
+		transfer.Abort()
+	}
+	<-done
+}
+
+// trackSession counts a session the shutdown waits for,
+// it returns false once the server is shutting down
+func (s *ServeSession) trackSession() bool {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if atomic.LoadInt32(&s.closing) != 0 {
+		return false
+	}
+	s.sessions.Add(1)
+	return true
+}
+
+func NewServeSession(config *ServerConfig) (*ServeSession, error) {
+	if config == nil {
+		config = NewServerConfig()
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+	var ports *PortRange
+	var err error
+	if config.TransferPorts != "" {
+		ports, err = ParsePortRange(config.TransferPorts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.TraceFormat {
+	case "", TracePcap, TraceText:
+	default:
+		return nil, fmt.Errorf("Unknown trace format %q, expected pcap or text", config.TraceFormat)
+	}
+
+	var upstream Upstream
+	if config.Upstream != "" {
+		upstream, err = NewUpstream(config.Upstream, config.UpstreamTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addresses := config.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+	listeners := make([]*Listener, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := newListener(address, config.SinglePort, config.BatchSize, logger)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.udpUtils.CloseConnection()
+			}
+			return nil, err
+		}
+		if listener.mux != nil {
+			listener.mux.logger = logger
+			listener.mux.idleTimeout, _ = sessionTimeout(config)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	fileStorage := config.Storage
+	if fileStorage == nil && config.Dedup {
+		fileStorage = NewDedupStore()
+	} else if fileStorage == nil {
+		fileStorage = NewFileStore()
+	}
+	fileStorage.SetLimits(config.StoreLimits)
+	// Snapshots keep the files written and the whiteouts
+	// hiding those of the roots, not the files of the roots
+	writable := fileStorage
+	if len(config.Roots) > 0 {
+		layers := []Storage{}
+		for _, root := range config.Roots {
+			layers = append(layers, NewDirStore(root))
+		}
+		overlay, _ := NewOverlayStorage(append(layers, fileStorage), len(layers))
+		writable = overlay.WritableLayer()
+		fileStorage = overlay
+	}
+	if upstream != nil {
+		upstreamStorage := NewUpstreamStorage(fileStorage, upstream, config.UpstreamCache)
+		upstreamStorage.logger = logger
+		fileStorage = upstreamStorage
+	}
+	var cache *CachingStorage
+	if config.CacheBytes > 0 {
+		cache = NewCachingStorage(fileStorage, config.CacheBytes)
+		fileStorage = cache
+	}
+	expiring := NewExpiringStorage(fileStorage, config.Expiry, config.ExpiryInterval)
+	expiring.logger = logger
+	fileStorage = expiring
+	if config.VerifyReads {
+		verifying := NewVerifyingStorage(fileStorage)
+		verifying.logger = logger
+		fileStorage = verifying
+	}
+
+	var snapshotter *Snapshotter
+	if config.SnapshotPath != "" {
+		err := LoadSnapshot(writable, config.SnapshotPath)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.udpUtils.CloseConnection()
+			}
+			return nil, err
+		}
+		snapshotter = NewSnapshotter(writable, config.SnapshotPath, config.SnapshotInterval)
+		snapshotter.logger = logger
+		snapshotter.Start()
+	}
+	expiring.Start()
+
+	transfers := NewTransferRegistry()
+	httpServers := []*http.Server{}
+	if config.AdminAddress != "" {
+		adminHandler := NewAdminHandler(fileStorage, transfers)
+		adminHandler.cache = cache
+		adminHandler.limits = config.StoreLimits
+		adminHandler.logger = logger
+		httpServers = append(httpServers, &http.Server{
+			Addr:    config.AdminAddress,
+			Handler: adminHandler,
+		})
+	}
+	if config.HTTPAddress != "" {
+		gateway := NewHTTPGateway(fileStorage, config.HTTPACL, config.Permissions)
+		gateway.logger = logger
+		httpServers = append(httpServers, &http.Server{
+			Addr:    config.HTTPAddress,
+			Handler: gateway,
+		})
+	}
+
 	return &ServeSession{
-		udpUtils:    udpUtils,
-		fileStorage: NewFileStore(),
+		listeners:   listeners,
+		ports:       ports,
+		fileStorage: fileStorage,
+		folds:       newFoldIndex(fileStorage),
+		config:      config,
+		snapshotter: snapshotter,
+		expiring:    expiring,
+		transfers:   transfers,
+		httpServers: httpServers,
+		logger:      logger,
+		requestLimiter: NewRequestLimiter(
+			config.RequestRate, config.RequestBurst,
+			config.ClientRequestRate, config.ClientRequestBurst),
+		sessionLimiter: NewSessionLimiter(config.MaxSessions, config.MaxClientSessions),
+		sessions:       &sync.WaitGroup{},
+		mutex:          &sync.Mutex{},
 	}, nil
 }
 
-// ResolvePacket determines from initial request info
+// ResolvePacket determines from initial request info received on a listener
 // what to do (spawn a write/read session or handles the error)
-func (s *ServeSession) ResolvePacket(packet []byte, addr *net.UDPAddr) (bool, error) {
-	opCode, err := getOpCode(packet)
+func (s *ServeSession) ResolvePacket(listener *Listener, packet *Packet) (bool, error) {
+	opCode, err := getOpCode(packet.Data)
 	if err != nil {
 		return false, err
 	}
 
 	switch opCode {
 	case WRQ:
-		err := s.StartSession(packet, addr, SpawnWriteSession)
+		reqInfo, err := s.requestInfo(listener, opCode, packet)
+		if err != nil {
+			return false, err
+		}
+		if reqInfo == nil {
+			return true, nil
+		}
+		allowed, err := s.checkAccess(listener, opCode, reqInfo, packet)
+		if err != nil {
+			return false, err
+		}
+		if !allowed {
+			return true, nil
+		}
+		err = s.StartSession(listener, packet, reqInfo, SpawnWriteSession)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	case RRQ:
-		err := s.StartSession(packet, addr, SpawnReadSession)
+		reqInfo, err := s.requestInfo(listener, opCode, packet)
+		if err != nil {
+			return false, err
+		}
+		if reqInfo == nil {
+			return true, nil
+		}
+		allowed, err := s.checkAccess(listener, opCode, reqInfo, packet)
+		if err != nil {
+			return false, err
+		}
+		if !allowed {
+			return true, nil
+		}
+		err = s.StartSession(listener, packet, reqInfo, SpawnReadSession)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	case ERROR:
-		err := handleError(packet)
+		err := handleError(packet.Data, nil, s.logger.WithFields(Fields{"client": packet.Remote.String()}))
 		if err != nil {
 			return false, err
 		}
 		return true, nil
+	case DATA, ACK, OACK:
+		// Packets of no running session, such as a last block sent
+		// again after the transfer ended, as RFC 1350 has it
+		msg := "Unknown transfer ID"
+		s.logger.WithFields(Fields{"client": packet.Remote.String()}).Warnf("%v: %v", msg, decodePacket(packet.Data))
+		sendErrorPacketTo(UnknownTransferIDErr, msg, listener.udpUtils, packet)
+		return true, nil
 	default:
-		return false, fmt.Errorf("S: Opcode unknown or currently unsupported: %v", opCode)
+		return false, fmt.Errorf("Opcode unknown or currently unsupported: %v", opCode)
 	}
 }
 
-// StartSession starts a session in a new goroutine.
+// requestInfo parses a request and rewrites its filename to the one
+// to serve. Requests over the rate limits are refused before any
+// rewriting, and a request refused by the rewrite rules is reported
+// back to the client as an access violation, both yield no request info.
+func (s *ServeSession) requestInfo(listener *Listener, opCode uint16, packet *Packet) (*RequestInfo, error) {
+	reqInfo, err := createRequestInfo(packet.Data)
+	if err != nil {
+		return nil, err
+	}
+	reqInfo.remote = packet.Remote
+	reqInfo.audit = s.config.Audit
+	fields := Fields{
+		"client":   packet.Remote.String(),
+		"filename": reqInfo.filename,
+		"mode":     reqInfo.mode,
+		"options":  reqInfo.options,
+	}
+	logger := s.logger.WithFields(fields)
+	reqInfo.logger = logger
+
+	if !s.requestLimiter.Allow(packet.Remote.IP) {
+		msg := "Request rate exceeded, try again later"
+		logger.Warnf("%v (%v from %v)", msg, reqInfo.filename, packet.Remote)
+		reqInfo.auditRefusal(opCode, UnknownErr, msg)
+		sendErrorPacketTo(UnknownErr, msg, listener.udpUtils, packet)
+		return nil, nil
+	}
+
+	filename, err := s.config.Rewriter.Rewrite(reqInfo.filename, opCode, reqInfo.remote)
+	if err != nil {
+		msg := fmt.Sprintf("Access to %v denied for %v: %v", reqInfo.filename, packet.Remote.IP, err)
+		logger.Errorf("%v", msg)
+		reqInfo.auditRefusal(opCode, AccessViolationErr, msg)
+		sendErrorPacketTo(AccessViolationErr, msg, listener.udpUtils, packet)
+		return nil, nil
+	}
+	if opCode == RRQ && s.config.Rewriter != nil && s.config.Rewriter.CaseInsensitive &&
+		!s.fileStorage.DoesFileExist(filename) {
+		if folded, ok := s.folds.find(filename); ok {
+			filename = folded
+		}
+	}
+	if filename != reqInfo.filename {
+		logger.Debugf("Rewrote %v to %v", reqInfo.filename, filename)
+		fields["requested"] = reqInfo.filename
+		fields["filename"] = filename
+		logger = s.logger.WithFields(fields)
+		reqInfo.filename = filename
+	}
+	reqInfo.logger = logger
+	return reqInfo, nil
+}
+
+// checkAccess verifies the client is allowed to make the request
+// and the file permits the operation before any session is spawned,
+// otherwise an access violation is reported back to the client.
+func (s *ServeSession) checkAccess(listener *Listener, opCode uint16, reqInfo *RequestInfo, packet *Packet) (bool, error) {
+	addr := packet.Remote
+
+	var msg string
+	switch {
+	case opCode == RRQ && !s.config.ReadACL.IsAllowed(addr.IP, reqInfo.filename):
+		msg = fmt.Sprintf("Read access to %v denied for %v", reqInfo.filename, addr.IP)
+	case opCode == WRQ && !s.config.WriteACL.IsAllowed(addr.IP, reqInfo.filename):
+		msg = fmt.Sprintf("Write access to %v denied for %v", reqInfo.filename, addr.IP)
+	case opCode == RRQ && !s.config.Permissions.CanRead(reqInfo.filename):
+		msg = fmt.Sprintf("File %v is not readable", reqInfo.filename)
+	case opCode == WRQ && !s.config.Permissions.CanWrite(reqInfo.filename):
+		msg = fmt.Sprintf("File %v is not writable", reqInfo.filename)
+	default:
+		return true, nil
+	}
+	reqInfo.log().Errorf("%v", msg)
+	reqInfo.auditRefusal(opCode, AccessViolationErr, msg)
+	sendErrorPacketTo(AccessViolationErr, msg, listener.udpUtils, packet)
+	return false, nil
+}
+
+// StartSession starts a session in a new goroutine
+// unless the session limits are hit, in which case
+// the client is told to try again later.
 // It handles error by reporting to the console to avoid
 // affecting other goroutines.
 func (s *ServeSession) StartSession(
-	packet []byte,
-	addr *net.UDPAddr,
+	listener *Listener,
+	packet *Packet,
+	reqInfo *RequestInfo,
 	funcSig SpawnerFunction) error {
 
-	reqInfo, err := createRequestInfo(packet)
+	addr := packet.Remote
+	opCode, _ := getOpCode(packet.Data)
+
+	if !s.trackSession() {
+		msg := "Server shutting down, try again later"
+		reqInfo.log().Warnf("%v (%v from %v)", msg, reqInfo.filename, addr)
+		reqInfo.auditRefusal(opCode, UnknownErr, msg)
+		sendErrorPacketTo(UnknownErr, msg, listener.udpUtils, packet)
+		return nil
+	}
+	// The session is no longer waited for unless it gets started
+	started := false
+	defer func() {
+		if !started {
+			s.sessions.Done()
+		}
+	}()
+
+	if !s.sessionLimiter.Acquire(addr.IP) {
+		msg := "Too many concurrent transfers, try again later"
+		reqInfo.log().Warnf("%v (%v from %v)", msg, reqInfo.filename, addr)
+		reqInfo.auditRefusal(opCode, UnknownErr, msg)
+		sendErrorPacketTo(UnknownErr, msg, listener.udpUtils, packet)
+		return nil
+	}
+
+	sessionConn, err := s.openSessionConn(listener, packet)
 	if err != nil {
-		return err
+		s.sessionLimiter.Release(addr.IP)
+		msg := "Cannot start a transfer, try again later"
+		reqInfo.log().Errorf("%v (%v from %v): %v", msg, reqInfo.filename, addr, err)
+		reqInfo.auditRefusal(opCode, UnknownErr, msg)
+		sendErrorPacketTo(UnknownErr, msg, listener.udpUtils, packet)
+		return nil
+	}
+
+	direction := operationName(opCode)
+	transfer := NewTransfer(direction, reqInfo, addr)
+	s.transfers.Add(transfer)
+	// Sessions are told apart in the logs by the ID of their transfer
+	reqInfo.logger = reqInfo.log().WithFields(Fields{
+		"session_id": transfer.ID,
+		"direction":  direction,
+	})
+
+	sessionConn.logger = reqInfo.log()
+	if trace := s.openTrace(listener, packet, reqInfo, transfer); trace != nil {
+		sessionConn.setTrace(trace)
 	}
 
+	started = true
 	go func() {
-		err := funcSig(s.fileStorage, reqInfo, addr)
+		defer s.sessions.Done()
+		defer s.sessionLimiter.Release(addr.IP)
+		defer s.transfers.Remove(transfer)
+		defer sessionConn.recycle()
+		if sessionConn.trace != nil {
+			defer sessionConn.trace.Close()
+		}
+		err := funcSig(s.fileStorage, reqInfo, sessionConn, transfer)
 		if err != nil {
-			logrus.Errorf("%v", err)
+			reqInfo.log().Errorf("%v", err)
 		}
 	}()
 	return nil
 }
+
+// openTrace starts the packet trace of a session when its client is
+// traced, the request being the first packet of the trace
+func (s *ServeSession) openTrace(listener *Listener, packet *Packet, reqInfo *RequestInfo, transfer *Transfer) PacketTrace {
+	addr := packet.Remote
+	if s.config.TraceDir == "" || !s.config.TraceClients.IsAllowed(addr.IP, reqInfo.filename) {
+		return nil
+	}
+
+	format := s.config.TraceFormat
+	if format == "" {
+		format = TracePcap
+	}
+	// Session IDs start over with the server, the time keeps
+	// the traces of successive runs apart
+	name := fmt.Sprintf("%v-%v-%v.%v", transfer.Started.Format("20060102T150405"), transfer.ID,
+		strings.Replace(addr.IP.String(), ":", "-", -1), format)
+	file, err := os.Create(filepath.Join(s.config.TraceDir, name))
+	if err != nil {
+		reqInfo.log().Errorf("Cannot trace the session: %v", err)
+		return nil
+	}
+	trace, err := NewPacketTrace(file, format)
+	if err != nil {
+		reqInfo.log().Errorf("Cannot trace the session: %v", err)
+		return nil
+	}
+	reqInfo.log().Infof("Tracing the session to %v", name)
+
+	local := listener.udpUtils.connection.LocalAddr().(*net.UDPAddr)
+	if packet.Local != nil {
+		local = &net.UDPAddr{IP: packet.Local.IP, Port: local.Port}
+	}
+	trace.Packet(false, local, addr, packet.Data)
+	return trace
+}
+
+// openSessionConn creates the connection a session talks to the client over,
+// either multiplexed on the listening socket or on a new socket
+// bound to the address the request was sent to.
+func (s *ServeSession) openSessionConn(listener *Listener, packet *Packet) (*UDPUtils, error) {
+	var sessionConn *UDPUtils
+	var err error
+	switch {
+	case listener.mux != nil:
+		sessionConn, err = listener.mux.Open(packet)
+	case s.ports != nil:
+		sessionConn, err = s.dialFromPortRange(listener.sessionHost(packet), packet.Remote)
+	default:
+		localAddr := net.JoinHostPort(listener.sessionHost(packet), "0")
+		sessionConn, err = NewUDPUtils(localAddr, packet.Remote.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if listener.mux == nil {
+		s.logger.Infof("Dialing: %v", packet.Remote)
+	}
+	sessionConn.SetBandwidth(s.config.SessionBandwidth)
+	sessionConn.SetTimeout(sessionTimeout(s.config))
+	return sessionConn, nil
+}
+
+// sessionTimeout returns how long and how many times
+// sessions wait for a silent client
+func sessionTimeout(config *ServerConfig) (time.Duration, int) {
+	timeout, retries := config.Timeout, config.Retries
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	return timeout, retries
+}
+
+// dialFromPortRange creates a session connection on a port of the
+// transfer port range, skipping ports other programs are bound to.
+// The port goes back to the range once the connection is closed,
+// which happens when the session ends or times out on a silent client.
+func (s *ServeSession) dialFromPortRange(host string, addr *net.UDPAddr) (*UDPUtils, error) {
+	for i := 0; i < s.ports.Size(); i++ {
+		port, ok := s.ports.Acquire()
+		if !ok {
+			break
+		}
+		localAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		sessionConn, err := NewUDPUtils(localAddr, addr.String())
+		if err != nil {
+			s.ports.Release(port)
+			continue
+		}
+		sessionConn.onClose(func() {
+			s.ports.Release(port)
+		})
+		return sessionConn, nil
+	}
+	return nil, fmt.Errorf("Transfer port range exhausted, %v ports in use", s.ports.InUse())
+}
@@ -0,0 +1,268 @@
+package tftputils
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshotChecksumKey and snapshotCRC32Key are the PAX records holding
+// the SHA-256 and CRC-32 of every file in a snapshot archive, the others
+// hold its metadata, the modification time being the one of the header.
+// An empty entry with snapshotWhiteoutKey is a whiteout, not a file.
+const (
+	snapshotChecksumKey    = "SIMPLETFTP.sha256"
+	snapshotCRC32Key       = "SIMPLETFTP.crc32"
+	snapshotCreatedKey     = "SIMPLETFTP.created"
+	snapshotUploaderKey    = "SIMPLETFTP.uploader"
+	snapshotModeKey        = "SIMPLETFTP.mode"
+	snapshotContentTypeKey = "SIMPLETFTP.content_type"
+	snapshotExpiresKey     = "SIMPLETFTP.expires"
+	snapshotMaxReadsKey    = "SIMPLETFTP.max_reads"
+	snapshotWhiteoutKey    = "SIMPLETFTP.whiteout"
+)
+
+// whiteoutKeeper is implemented by storages hiding the files of
+// others, snapshots keep their whiteouts along with their files
+type whiteoutKeeper interface {
+	Whiteouts() []string
+	RestoreWhiteout(filename string)
+}
+
+// SaveSnapshot writes every file of the store to a tar archive at path.
+// The archive is written next to path first and renamed over it,
+// so a crash never leaves a half written snapshot behind.
+func SaveSnapshot(fileS Storage, path string) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	whiteouts := []string{}
+	if keeper, ok := fileS.(whiteoutKeeper); ok {
+		whiteouts = keeper.Whiteouts()
+	}
+	err = writeSnapshot(fileS.Files(), whiteouts, tempFile)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+func writeSnapshot(files []*FileObject, whiteouts []string, writer io.Writer) error {
+	tarWriter := tar.NewWriter(writer)
+	for _, file := range files {
+		checksum := file.SHA256()
+		metadata := file.Metadata()
+		header := &tar.Header{
+			Name:     file.filename,
+			Mode:     0644,
+			Size:     file.Size(),
+			ModTime:  metadata.Modified,
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				snapshotChecksumKey:    hex.EncodeToString(checksum[:]),
+				snapshotCRC32Key:       fmt.Sprintf("%08x", file.CRC32()),
+				snapshotCreatedKey:     metadata.Created.Format(time.RFC3339Nano),
+				snapshotUploaderKey:    metadata.Uploader,
+				snapshotModeKey:        metadata.Mode,
+				snapshotContentTypeKey: metadata.ContentType,
+			},
+		}
+		if !metadata.Expires.IsZero() {
+			header.PAXRecords[snapshotExpiresKey] = metadata.Expires.Format(time.RFC3339Nano)
+		}
+		if metadata.MaxReads > 0 {
+			header.PAXRecords[snapshotMaxReadsKey] = strconv.Itoa(metadata.MaxReads)
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, file.NewReader()); err != nil {
+			return err
+		}
+	}
+	for _, filename := range whiteouts {
+		header := &tar.Header{
+			Name:       filename,
+			Mode:       0644,
+			ModTime:    time.Now(),
+			Typeflag:   tar.TypeReg,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{snapshotWhiteoutKey: "1"},
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	return tarWriter.Close()
+}
+
+// LoadSnapshot puts every file of the snapshot archive at path
+// into the store, verifying its checksum first, and restores the
+// whiteouts of the archive when the store keeps any.
+// A missing snapshot is not an error, there is nothing to restore yet.
+func LoadSnapshot(fileS Storage, path string) error {
+	snapshot, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	tarReader := tar.NewReader(snapshot)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := header.PAXRecords[snapshotWhiteoutKey]; ok {
+			if keeper, ok := fileS.(whiteoutKeeper); ok {
+				keeper.RestoreWhiteout(header.Name)
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		checksum := sha256.Sum256(data)
+		if header.PAXRecords[snapshotChecksumKey] != hex.EncodeToString(checksum[:]) {
+			return fmt.Errorf("Snapshot %v: checksum mismatch for %v", path, header.Name)
+		}
+		// Snapshots from before CRC-32 was recorded only hold the SHA-256
+		crc := crc32.ChecksumIEEE(data)
+		if record, ok := header.PAXRecords[snapshotCRC32Key]; ok && record != fmt.Sprintf("%08x", crc) {
+			return fmt.Errorf("Snapshot %v: CRC-32 mismatch for %v", path, header.Name)
+		}
+
+		file := NewFileObject(header.Name, data)
+		file.setChecksums(checksum, crc)
+		file.SetMetadata(snapshotMetadata(header))
+		err = fileS.Put(file)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// snapshotMetadata reads the metadata of a file from its header,
+// snapshots from before metadata was recorded leave it to the store
+func snapshotMetadata(header *tar.Header) FileMetadata {
+	metadata := FileMetadata{
+		Uploader:    header.PAXRecords[snapshotUploaderKey],
+		Mode:        header.PAXRecords[snapshotModeKey],
+		ContentType: header.PAXRecords[snapshotContentTypeKey],
+	}
+	created, err := time.Parse(time.RFC3339Nano, header.PAXRecords[snapshotCreatedKey])
+	if err == nil {
+		metadata.Created = created
+		metadata.Modified = header.ModTime
+	}
+	if expires, err := time.Parse(time.RFC3339Nano, header.PAXRecords[snapshotExpiresKey]); err == nil {
+		metadata.Expires = expires
+	}
+	if maxReads, err := strconv.Atoi(header.PAXRecords[snapshotMaxReadsKey]); err == nil {
+		metadata.MaxReads = maxReads
+	}
+	return metadata
+}
+
+// Snapshotter periodically saves a file store to a snapshot
+// whenever its content has changed since the last save
+type Snapshotter struct {
+	fileStorage  Storage
+	path         string
+	interval     time.Duration
+	savedVersion uint64
+	logger       Logger
+	mutex        *sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func NewSnapshotter(fileS Storage, path string, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		fileStorage:  fileS,
+		path:         path,
+		interval:     interval,
+		savedVersion: fileS.Version(),
+		logger:       defaultLogger,
+		mutex:        &sync.Mutex{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start saves the snapshot in a new goroutine every interval,
+// a zero interval only saves when the snapshotter is stopped.
+func (sn *Snapshotter) Start() {
+	go func() {
+		defer close(sn.done)
+		if sn.interval <= 0 {
+			<-sn.stop
+			return
+		}
+
+		ticker := time.NewTicker(sn.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := sn.Save(); err != nil {
+					sn.logger.Errorf("Cannot save snapshot: %v", err)
+				}
+			case <-sn.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Save writes the snapshot if the store changed since the last save
+func (sn *Snapshotter) Save() error {
+	defer sn.mutex.Unlock()
+	sn.mutex.Lock()
+
+	version := sn.fileStorage.Version()
+	if version == sn.savedVersion {
+		return nil
+	}
+	err := SaveSnapshot(sn.fileStorage, sn.path)
+	if err != nil {
+		return err
+	}
+	sn.savedVersion = version
+	sn.logger.Infof("Saved snapshot to %v", sn.path)
+	return nil
+}
+
+// Stop ends the periodic saving and saves one last time
+func (sn *Snapshotter) Stop() error {
+	close(sn.stop)
+	<-sn.done
+	return sn.Save()
+}
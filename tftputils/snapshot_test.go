@@ -0,0 +1,197 @@
+package tftputils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSnapshotPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "store.tar"), func() { os.RemoveAll(dir) }
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	file, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+	assert.Nil(t, fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+	assert.Nil(t, SaveSnapshot(fileStorage, path))
+
+	restored := NewFileStore()
+	assert.Nil(t, LoadSnapshot(restored, path))
+	actualFile, err := restored.Get(file.filename)
+	assert.Nil(t, err)
+	assert.Equal(t, file.Size(), actualFile.Size())
+	assert.Equal(t, file.SHA256(), actualFile.SHA256())
+	assert.Len(t, restored.Files(), 2)
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	fileStorage := NewFileStore()
+	file := NewFileObject("boot/pxelinux.0", []byte("boot"))
+	file.SetMetadata(FileMetadata{
+		Created:  time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Modified: time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Uploader: "10.0.0.1",
+		Mode:     "octet",
+		Expires:  time.Date(2100, 1, 2, 3, 4, 5, 6, time.UTC),
+		MaxReads: 3,
+	})
+	assert.Nil(t, fileStorage.Put(file))
+	assert.Nil(t, SaveSnapshot(fileStorage, path))
+
+	restored := NewFileStore()
+	assert.Nil(t, LoadSnapshot(restored, path))
+	actualFile, err := restored.Get(file.filename)
+	assert.Nil(t, err)
+	metadata := actualFile.Metadata()
+	assert.True(t, file.Metadata().Created.Equal(metadata.Created))
+	assert.True(t, file.Metadata().Modified.Equal(metadata.Modified))
+	assert.Equal(t, "10.0.0.1", metadata.Uploader)
+	assert.Equal(t, "octet", metadata.Mode)
+	assert.True(t, file.Metadata().Expires.Equal(metadata.Expires))
+	assert.Equal(t, 3, metadata.MaxReads)
+	assert.Equal(t, file.Metadata().ContentType, metadata.ContentType)
+}
+
+func TestLoadMissingSnapshot(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	fileStorage := NewFileStore()
+	assert.Nil(t, LoadSnapshot(fileStorage, path))
+	assert.Empty(t, fileStorage.Files())
+}
+
+func TestLoadCorruptSnapshot(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	_, fileStorage, err := writeAFile()
+	assert.Nil(t, err)
+	assert.Nil(t, SaveSnapshot(fileStorage, path))
+
+	// Flip a byte of the file content, which sits in the
+	// block after the PAX and file headers
+	archive, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	archive[3*512] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(path, archive, 0644))
+
+	err = LoadSnapshot(NewFileStore(), path)
+	assert.NotNil(t, err)
+}
+
+func TestSnapshotterSavesOnStop(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	fileStorage := NewFileStore()
+	snapshotter := NewSnapshotter(fileStorage, path, time.Hour)
+	snapshotter.Start()
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	file := NewFileObject("hello.txt", []byte{0x12, 0x33, 0x33})
+	assert.Nil(t, fileStorage.Put(file))
+	assert.Nil(t, snapshotter.Stop())
+
+	restored := NewFileStore()
+	assert.Nil(t, LoadSnapshot(restored, path))
+	assert.True(t, restored.DoesFileExist(file.filename))
+}
+
+func TestShutdownWaitsForUploads(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	config := NewServerConfig()
+	config.SnapshotPath = path
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(WRQ, "upload.bin", OCTET), serverAddr))
+	_, session, err := client.ReadFromConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte{0x42}, SmallestBlockSize)
+	assert.Nil(t, client.WriteToAddr(createDataPacket(1, block), session))
+	_, _, err = client.ReadFromConn()
+	assert.Nil(t, err)
+
+	// The shutdown waits for the upload to end before the last snapshot
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("Shut down with an upload running")
+	default:
+	}
+	assert.Nil(t, client.WriteToAddr(createDataPacket(2, []byte("end")), session))
+	assert.Nil(t, <-shutdown)
+
+	restored := NewFileStore()
+	assert.Nil(t, LoadSnapshot(restored, path))
+	file, err := restored.Get("upload.bin")
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(SmallestBlockSize+3), file.Size())
+	}
+}
+
+func TestShutdownAbortsStalledTransfers(t *testing.T) {
+	config := NewServerConfig()
+	config.ShutdownTimeout = 20 * time.Millisecond
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	serverAddr, err := net.ResolveUDPAddr("udp", server.LocalAddresses()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseConnection()
+	assert.Nil(t, client.WriteToAddr(createRequestPacket(WRQ, "upload.bin", OCTET), serverAddr))
+	_, _, err = client.ReadFromConn()
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.Shutdown())
+	assert.Equal(t, 0, server.sessionLimiter.Active())
+	assert.False(t, server.fileStorage.DoesFileExist("upload.bin"))
+}
@@ -0,0 +1,69 @@
+package tftputils
+
+// Storage keeps the files the server serves and receives.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Put stores a file, failing when one with the same name exists
+	Put(file *FileObject) error
+	// Replace stores a file, overwriting any file with the same name
+	Replace(file *FileObject) error
+	Get(filename string) (*FileObject, error)
+	Delete(filename string) error
+	DoesFileExist(filename string) bool
+	// Files returns every stored file sorted by filename
+	Files() []*FileObject
+
+	// SetLimits changes the limits applied to files stored from now on,
+	// CheckQuota determines whether a new file of the given size fits
+	SetLimits(limits StoreLimits)
+	CheckQuota(size int64) error
+
+	// Version changes every time the content of the storage changes
+	Version() uint64
+}
+
+// VerifyingStorage checks the content of every file read against the
+// checksums recorded when it was stored, refusing files that changed
+// since, such as after silent corruption on disk. Files stored without
+// checksums, such as those of root directories, are served unchecked.
+type VerifyingStorage struct {
+	Storage
+	logger Logger
+}
+
+func NewVerifyingStorage(storage Storage) *VerifyingStorage {
+	return &VerifyingStorage{Storage: storage, logger: defaultLogger}
+}
+
+func (vs *VerifyingStorage) Get(filename string) (*FileObject, error) {
+	file, err := vs.Storage.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	// A file without recorded checksums, such as one of a root
+	// directory, would only be compared against itself
+	if _, _, ok := file.knownChecksums(); !ok {
+		vs.logger.Warnf("Cannot verify %v, no checksum was recorded for it", filename)
+		return file, nil
+	}
+	if err := file.Verify(); err != nil {
+		vs.logger.Errorf("%v", err)
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// ReserveRead and ReleaseRead pass reads in progress on to the wrapped storage
+func (vs *VerifyingStorage) ReserveRead(filename string) error {
+	return reserveRead(vs.Storage, filename)
+}
+
+func (vs *VerifyingStorage) ReleaseRead(filename string) {
+	releaseRead(vs.Storage, filename)
+}
+
+// RecordRead passes completed reads on to the wrapped storage
+func (vs *VerifyingStorage) RecordRead(filename string) {
+	recordRead(vs.Storage, filename)
+}
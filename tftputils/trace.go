@@ -0,0 +1,283 @@
+package tftputils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats packet traces are written in
+const (
+	TracePcap = "pcap"
+	TraceText = "text"
+)
+
+// PacketTrace records every packet of a session
+// sent or received between local and remote
+type PacketTrace interface {
+	Packet(sent bool, local *net.UDPAddr, remote *net.UDPAddr, data []byte)
+	Close() error
+}
+
+// NewPacketTrace writes a trace in the format given to w,
+// closing w when the trace is closed
+func NewPacketTrace(w io.WriteCloser, format string) (PacketTrace, error) {
+	switch format {
+	case "", TracePcap:
+		return NewPcapTrace(w)
+	case TraceText:
+		return NewTextTrace(w), nil
+	default:
+		return nil, fmt.Errorf("Unknown trace format %q, expected pcap or text", format)
+	}
+}
+
+// traceWriter serializes the writes of a trace, the packets of a session
+// being written by the session and by whoever aborts it. Packets traced
+// once the trace is closed are dropped.
+type traceWriter struct {
+	w      io.WriteCloser
+	err    error
+	closed bool
+	mutex  *sync.Mutex
+}
+
+func newTraceWriter(w io.WriteCloser) traceWriter {
+	return traceWriter{w: w, mutex: &sync.Mutex{}}
+}
+
+// write keeps the first error, traces being best effort
+func (tw *traceWriter) write(chunks ...[]byte) {
+	defer tw.mutex.Unlock()
+	tw.mutex.Lock()
+
+	for _, chunk := range chunks {
+		if tw.closed || tw.err != nil {
+			return
+		}
+		_, tw.err = tw.w.Write(chunk)
+	}
+}
+
+// Close closes the writer, returning the first error writing to it
+func (tw *traceWriter) Close() error {
+	defer tw.mutex.Unlock()
+	tw.mutex.Lock()
+
+	if tw.closed {
+		return nil
+	}
+	tw.closed = true
+	if err := tw.w.Close(); tw.err == nil {
+		tw.err = err
+	}
+	return tw.err
+}
+
+// TextTrace writes a line per packet with its decoded fields, such as
+// 2026-10-19T12:00:00.000001Z sent 10.0.0.1:69 > 10.0.0.2:2048 DATA block=1 length=512
+type TextTrace struct {
+	traceWriter
+}
+
+func NewTextTrace(w io.WriteCloser) *TextTrace {
+	return &TextTrace{traceWriter: newTraceWriter(w)}
+}
+
+func (tt *TextTrace) Packet(sent bool, local *net.UDPAddr, remote *net.UDPAddr, data []byte) {
+	direction, source, destination := "received", remote, local
+	if sent {
+		direction, source, destination = "sent", local, remote
+	}
+	line := fmt.Sprintf("%v %v %v > %v %v\n", time.Now().UTC().Format(time.RFC3339Nano),
+		direction, source, destination, decodePacket(data))
+	tt.write([]byte(line))
+}
+
+// decodePacket describes the fields of a TFTP packet
+func decodePacket(data []byte) string {
+	opCode, err := getOpCode(data)
+	if err != nil {
+		return fmt.Sprintf("MALFORMED length=%v", len(data))
+	}
+	switch opCode {
+	case RRQ, WRQ:
+		name := "RRQ"
+		if opCode == WRQ {
+			name = "WRQ"
+		}
+		filename, mode, err := getRequestInfo(data)
+		if err != nil {
+			return fmt.Sprintf("%v MALFORMED length=%v", name, len(data))
+		}
+		return fmt.Sprintf("%v %q mode=%v%v", name, filename, mode, formatOptions(getRequestOptions(data)))
+	case DATA:
+		block, err := getAck(data)
+		if err != nil {
+			return fmt.Sprintf("DATA MALFORMED length=%v", len(data))
+		}
+		return fmt.Sprintf("DATA block=%v length=%v", block, len(data)-4)
+	case ACK:
+		block, err := getAck(data)
+		if err != nil {
+			return fmt.Sprintf("ACK MALFORMED length=%v", len(data))
+		}
+		return fmt.Sprintf("ACK block=%v", block)
+	case ERROR:
+		if len(data) < 5 {
+			return fmt.Sprintf("ERROR MALFORMED length=%v", len(data))
+		}
+		code := binary.BigEndian.Uint16(data[2:])
+		return fmt.Sprintf("ERROR code=%v message=%q", code, strings.TrimRight(string(data[4:]), "\x00"))
+	case OACK:
+		return "OACK" + formatOptions(getOptionAck(data))
+	default:
+		return fmt.Sprintf("UNKNOWN opcode=%v length=%v", opCode, len(data))
+	}
+}
+
+// formatOptions lists options sorted by name, each after a space
+func formatOptions(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := ""
+	for _, name := range names {
+		formatted += fmt.Sprintf(" %v=%v", name, options[name])
+	}
+	return formatted
+}
+
+// pcap file format, with packets starting at their IP header
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	pcapLinkType = 101 // LINKTYPE_RAW
+	ipv4Header   = 20
+	ipv6Header   = 40
+	udpHeader    = 8
+	udpProtocol  = 17
+)
+
+// PcapTrace writes packets to a pcap file, along with the IP and UDP
+// headers they would have had on the wire, for Wireshark and tcpdump
+type PcapTrace struct {
+	traceWriter
+}
+
+// NewPcapTrace writes the header of the pcap file
+func NewPcapTrace(w io.WriteCloser) (*PcapTrace, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkType)
+	if _, err := w.Write(header); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &PcapTrace{traceWriter: newTraceWriter(w)}, nil
+}
+
+func (pt *PcapTrace) Packet(sent bool, local *net.UDPAddr, remote *net.UDPAddr, data []byte) {
+	source, destination := remote, local
+	if sent {
+		source, destination = local, remote
+	}
+	packet, err := ipPacket(source, destination, data)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	pt.write(record, packet)
+}
+
+// ipPacket wraps a datagram in UDP and IP headers, IPv4 ones when both
+// addresses are IPv4 and IPv6 ones otherwise
+func ipPacket(source *net.UDPAddr, destination *net.UDPAddr, data []byte) ([]byte, error) {
+	udpLength := udpHeader + len(data)
+	if udpLength > 0xffff {
+		return nil, errors.New("Datagram too large")
+	}
+	sourceIP, destinationIP := source.IP.To4(), destination.IP.To4()
+	var packet []byte
+	if sourceIP != nil && destinationIP != nil {
+		packet = make([]byte, ipv4Header+udpLength)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[6] = 0x40 // don't fragment
+		packet[8] = 64
+		packet[9] = udpProtocol
+		copy(packet[12:], sourceIP)
+		copy(packet[16:], destinationIP)
+		binary.BigEndian.PutUint16(packet[10:], ^checksumAdd(0, packet[:ipv4Header]))
+	} else {
+		sourceIP, destinationIP = ipv6Of(source.IP), ipv6Of(destination.IP)
+		packet = make([]byte, ipv6Header+udpLength)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(udpLength))
+		packet[6] = udpProtocol
+		packet[7] = 64
+		copy(packet[8:], sourceIP)
+		copy(packet[24:], destinationIP)
+	}
+
+	udp := packet[len(packet)-udpLength:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(source.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(destination.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLength))
+	copy(udp[udpHeader:], data)
+
+	// The checksum covers a pseudo header of the addresses,
+	// the protocol and the length, then the datagram
+	pseudo := make([]byte, 4)
+	binary.BigEndian.PutUint16(pseudo[0:], udpProtocol)
+	binary.BigEndian.PutUint16(pseudo[2:], uint16(udpLength))
+	sum := checksumAdd(0, sourceIP)
+	sum = checksumAdd(sum, destinationIP)
+	sum = checksumAdd(sum, pseudo)
+	checksum := ^checksumAdd(sum, udp)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum)
+	return packet, nil
+}
+
+func ipv6Of(ip net.IP) net.IP {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv6unspecified
+}
+
+// checksumAdd adds data to a ones' complement sum of 16 bit words,
+// as the internet checksum, padding odd lengths with a zero byte
+func checksumAdd(sum uint16, data []byte) uint16 {
+	total := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+	for total > 0xffff {
+		total = total&0xffff + total>>16
+	}
+	return uint16(total)
+}
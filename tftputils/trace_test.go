@@ -0,0 +1,191 @@
+package tftputils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// closingBuffer is a trace output kept in memory
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDecodePacket(t *testing.T) {
+	for packet, decoded := range map[string]string{
+		string(createRequestPacket(RRQ, "boot/pxelinux.0", OCTET, "tsize", "0", "blksize", "1468")): `RRQ "boot/pxelinux.0" mode=octet blksize=1468 tsize=0`,
+		string(createRequestPacket(WRQ, "backup.cfg", OCTET)):                                       `WRQ "backup.cfg" mode=octet`,
+		string(createDataPacket(3, make([]byte, 100))):                                              "DATA block=3 length=100",
+		string(createAckPacket(65535)):                                                              "ACK block=65535",
+		string(createErrorPacket(FileNotFoundErr, "File missing does not exist")):                   `ERROR code=1 message="File missing does not exist"`,
+		"\x00\x06tsize\x004096\x00":                                                                 "OACK tsize=4096",
+		"\x00\x09":                                                                                  "UNKNOWN opcode=9 length=2",
+		"\x00":                                                                                      "MALFORMED length=1",
+		"\x00\x04\x00":                                                                              "ACK MALFORMED length=3",
+	} {
+		assert.Equal(t, decoded, decodePacket([]byte(packet)))
+	}
+}
+
+func TestTextTrace(t *testing.T) {
+	output := &closingBuffer{}
+	trace, err := NewPacketTrace(output, TraceText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 69}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2048}
+	trace.Packet(false, server, client, createAckPacket(1))
+	trace.Packet(true, server, client, createDataPacket(2, []byte("boot")))
+	assert.Nil(t, trace.Close())
+	assert.True(t, output.closed)
+	trace.Packet(false, server, client, createAckPacket(2))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		fields := strings.SplitN(lines[0], " ", 2)
+		_, err := time.Parse(time.RFC3339Nano, fields[0])
+		assert.Nil(t, err)
+		assert.Equal(t, "received 10.0.0.2:2048 > 10.0.0.1:69 ACK block=1", fields[1])
+		assert.True(t, strings.HasSuffix(lines[1], " sent 10.0.0.1:69 > 10.0.0.2:2048 DATA block=2 length=4"))
+	}
+
+	_, err = NewPacketTrace(output, "json")
+	assert.NotNil(t, err)
+}
+
+func TestTraceSkipsFailedWrites(t *testing.T) {
+	output := &closingBuffer{}
+	trace, err := NewPacketTrace(output, TraceText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, err := NewUDPUtils("127.0.0.1:0", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection.setTrace(trace)
+
+	assert.Nil(t, connection.WriteToConn(createDataPacket(1, []byte("boot"))))
+	connection.connection.Close()
+	assert.NotNil(t, connection.WriteToConn(createDataPacket(2, []byte("boot"))))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if assert.Len(t, lines, 1) {
+		assert.True(t, strings.HasSuffix(lines[0], "DATA block=1 length=4"))
+	}
+}
+
+func TestPcapTrace(t *testing.T) {
+	output := &closingBuffer{}
+	trace, err := NewPacketTrace(output, TracePcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := createDataPacket(1, []byte("odd"))
+	server4 := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 69}
+	client4 := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2048}
+	server6 := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 69}
+	client6 := &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 2048}
+	trace.Packet(true, server4, client4, data)
+	trace.Packet(false, server6, client6, data)
+	assert.Nil(t, trace.Close())
+
+	file := output.Bytes()
+	assert.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(file))
+	assert.Equal(t, uint32(pcapLinkType), binary.LittleEndian.Uint32(file[20:]))
+	file = file[24:]
+
+	// IPv4, the checksums of the header and of the datagram add up
+	length := int(binary.LittleEndian.Uint32(file[8:]))
+	packet := file[16 : 16+length]
+	assert.Equal(t, ipv4Header+udpHeader+len(data), length)
+	assert.Equal(t, uint16(0xffff), checksumAdd(0, packet[:ipv4Header]))
+	assert.Equal(t, net.ParseIP("10.0.0.1").To4(), net.IP(packet[12:16]))
+	assert.Equal(t, uint16(69), binary.BigEndian.Uint16(packet[20:]))
+	assert.Equal(t, uint16(2048), binary.BigEndian.Uint16(packet[22:]))
+	pseudo := append(append(append([]byte{}, packet[12:20]...), 0, udpProtocol), packet[24:26]...)
+	assert.Equal(t, uint16(0xffff), checksumAdd(checksumAdd(0, pseudo), packet[ipv4Header:]))
+	assert.Equal(t, data, packet[ipv4Header+udpHeader:])
+	file = file[16+length:]
+
+	// IPv6, received from the client
+	length = int(binary.LittleEndian.Uint32(file[8:]))
+	packet = file[16 : 16+length]
+	assert.Equal(t, ipv6Header+udpHeader+len(data), length)
+	assert.Equal(t, byte(0x60), packet[0])
+	assert.Equal(t, net.ParseIP("fd00::2"), net.IP(packet[8:24]))
+	assert.Equal(t, uint16(2048), binary.BigEndian.Uint16(packet[40:]))
+	pseudo = append(append(append([]byte{}, packet[8:40]...), 0, udpProtocol), packet[44:46]...)
+	assert.Equal(t, uint16(0xffff), checksumAdd(checksumAdd(0, pseudo), packet[ipv6Header:]))
+	assert.Len(t, file, 16+length)
+}
+
+func TestServerTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := NewServerConfig()
+	config.TraceDir = dir
+	config.TraceFormat = TraceText
+	assert.Nil(t, config.TraceClients.Set("deny 127.0.0.1 quiet/"))
+	server, err := NewServeSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", []byte("boot"))))
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("quiet/config", []byte("quiet"))))
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	for _, filename := range []string{"boot/pxelinux.0", "quiet/config"} {
+		body, _, err := upstream.Fetch(filename)
+		if assert.Nil(t, err) {
+			ioutil.ReadAll(body)
+			body.Close()
+		}
+	}
+
+	// The trace is complete once the session is over
+	var traces []string
+	var content []byte
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		traces, _ = filepath.Glob(filepath.Join(dir, "*-1-127.0.0.1.text"))
+		if len(traces) == 1 {
+			content, _ = ioutil.ReadFile(traces[0])
+			if bytes.Contains(content, []byte("ACK block=1")) {
+				break
+			}
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `RRQ "boot/pxelinux.0" mode=octet`)
+		assert.Contains(t, lines[1], "sent")
+		assert.Contains(t, lines[1], "DATA block=1 length=4")
+		assert.Contains(t, lines[2], "received")
+		assert.Contains(t, lines[2], "ACK block=1")
+	}
+	all, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, all, 1)
+
+	config = NewServerConfig()
+	config.TraceFormat = "json"
+	_, err = NewServeSession(config)
+	assert.NotNil(t, err)
+}
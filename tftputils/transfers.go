@@ -0,0 +1,157 @@
+package tftputils
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReadDirection  = "read"
+	WriteDirection = "write"
+)
+
+// Transfer tracks the progress of a running read or write session
+// and lets it be aborted from outside of the session.
+// All methods are safe to call on a nil Transfer.
+type Transfer struct {
+	ID          uint64
+	Direction   string
+	Filename    string
+	Client      *net.UDPAddr
+	Started     time.Time
+	transferred int64
+	size        int64
+	mutex       *sync.Mutex
+	aborted     bool
+	abort       func()
+}
+
+func NewTransfer(direction string, reqInfo *RequestInfo, client *net.UDPAddr) *Transfer {
+	return &Transfer{
+		Direction: direction,
+		Filename:  reqInfo.filename,
+		Client:    client,
+		Started:   time.Now(),
+		size:      -1,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Transferred returns the number of bytes sent or received so far
+func (t *Transfer) Transferred() int64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.transferred)
+}
+
+// Size returns the size of the file or -1 when it isn't known yet
+func (t *Transfer) Size() int64 {
+	if t == nil {
+		return -1
+	}
+	return atomic.LoadInt64(&t.size)
+}
+
+func (t *Transfer) setTransferred(transferred int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.transferred, transferred)
+	}
+}
+
+func (t *Transfer) setSize(size int64) {
+	if t != nil {
+		atomic.StoreInt64(&t.size, size)
+	}
+}
+
+// onAbort registers how the session is torn down when aborted,
+// it runs right away if the transfer has been aborted already.
+func (t *Transfer) onAbort(abort func()) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	t.abort = abort
+	aborted := t.aborted
+	t.mutex.Unlock()
+
+	if aborted {
+		abort()
+	}
+}
+
+// Abort stops the session running the transfer
+func (t *Transfer) Abort() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	abort := t.abort
+	alreadyAborted := t.aborted
+	t.aborted = true
+	t.mutex.Unlock()
+
+	if abort != nil && !alreadyAborted {
+		abort()
+	}
+}
+
+// TransferRegistry keeps track of the running transfers of a server
+type TransferRegistry struct {
+	transfers map[uint64]*Transfer
+	lastID    uint64
+	mutex     *sync.Mutex
+}
+
+func NewTransferRegistry() *TransferRegistry {
+	return &TransferRegistry{
+		transfers: make(map[uint64]*Transfer),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Add assigns an ID to the transfer and keeps track of it
+func (tr *TransferRegistry) Add(transfer *Transfer) {
+	defer tr.mutex.Unlock()
+	tr.mutex.Lock()
+
+	tr.lastID++
+	transfer.ID = tr.lastID
+	tr.transfers[transfer.ID] = transfer
+}
+
+func (tr *TransferRegistry) Remove(transfer *Transfer) {
+	defer tr.mutex.Unlock()
+	tr.mutex.Lock()
+
+	delete(tr.transfers, transfer.ID)
+}
+
+func (tr *TransferRegistry) Get(id uint64) (*Transfer, bool) {
+	defer tr.mutex.Unlock()
+	tr.mutex.Lock()
+
+	transfer, ok := tr.transfers[id]
+	return transfer, ok
+}
+
+// List returns the running transfers, oldest first
+func (tr *TransferRegistry) List() []*Transfer {
+	defer tr.mutex.Unlock()
+	tr.mutex.Lock()
+
+	transfers := make([]*Transfer, 0, len(tr.transfers))
+	for _, transfer := range tr.transfers {
+		transfers = append(transfers, transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].ID < transfers[j].ID
+	})
+	return transfers
+}
@@ -1,19 +1,72 @@
 package tftputils
 
 import (
+	"errors"
+	"fmt"
 	"net"
-
-	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // UDPUtils abstracts the ability to read and write from the UDP connection.
+// A multiplexed UDPUtils shares the connection of the server with
+// other sessions and receives its packets from a SessionMux instead.
 type UDPUtils struct {
 	addr       *net.UDPAddr
 	connection *net.UDPConn
-	data       []byte
 	remoteAddr *net.UDPAddr
+	throttle   *TokenBucket
+
+	// family and oob are set on listening connections
+	// receiving packet info, see enablePacketInfo
+	family int
+	oob    []byte
+	// localIP and ifIndex are the address a multiplexed
+	// connection answers from, replyOOB the packet info saying so
+	localIP  net.IP
+	ifIndex  int
+	replyOOB []byte
+
+	// readBuf and sendBuf come from the packet pool and are reused
+	// across blocks, current is the last buffer read from the mux
+	readBuf *[]byte
+	sendBuf *[]byte
+	current *[]byte
+
+	// batch sends the datagrams of the connection when they are
+	// batched with those of other sessions on the same socket
+	batch *batchWriter
+
+	// lastError is the last error packet sent or received,
+	// telling how a session ended for the audit trail
+	lastError atomic.Pointer[tftpError]
+	// trace records the packets of a traced session,
+	// traceLocal being the address the session answers from
+	trace      PacketTrace
+	traceLocal *net.UDPAddr
+
+	// timeout bounds how long a session waits for the client before
+	// sending lastSent, the last packet written, again, up to retries
+	// times. A zero timeout waits forever.
+	timeout  time.Duration
+	retries  int
+	timer    *time.Timer
+	lastSent []byte
+
+	incoming  chan *[]byte
+	closed    chan struct{}
+	closeOnce *sync.Once
+	release   func()
+
+	// logger gets the socket errors, the one of
+	// the session for session connections
+	logger Logger
 }
 
+// errTimeout is returned by reads that received nothing in time
+var errTimeout = errors.New("Timed out waiting for a packet")
+
 func NewUDPUtils(initAddr string, remoteAddr string) (*UDPUtils, error) {
 	if initAddr == "" {
 		initAddr = "localhost:0"
@@ -21,63 +74,310 @@ func NewUDPUtils(initAddr string, remoteAddr string) (*UDPUtils, error) {
 
 	localAddr, err := net.ResolveUDPAddr("udp", initAddr)
 	if err != nil {
-		logrus.Errorf("Cannot resolve UDP address: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("Cannot resolve UDP address: %v", err)
 	}
 
 	var connection *net.UDPConn
 	var remoteUDPAddr *net.UDPAddr
 
 	if remoteAddr != "" {
-		remoteUDPAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+		remoteUDPAddr, err = net.ResolveUDPAddr("udp", remoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot resolve UDP address: %v", err)
+		}
 		connection, err = net.DialUDP("udp", localAddr, remoteUDPAddr)
 		if err != nil {
-			logrus.Errorf("Cannot dial to UDP: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("Cannot dial to UDP: %v", err)
 		}
-		logrus.Infof("Dialing: %v", remoteAddr)
 	} else {
-		connection, err = net.ListenUDP("udp", localAddr)
+		connection, err = net.ListenUDP(listenNetwork(localAddr), localAddr)
 		if err != nil {
-			logrus.Errorf("Cannot listen to UDP: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("Cannot listen to UDP: %v", err)
 		}
-		logrus.Infof("Listening UDP at %v", connection.LocalAddr())
 	}
 
 	return &UDPUtils{
 		addr:       localAddr,
 		remoteAddr: remoteUDPAddr,
 		connection: connection,
-		data:       make([]byte, 1024),
+		readBuf:    getPacketBuffer(),
+		closeOnce:  &sync.Once{},
+		logger:     defaultLogger,
 	}, nil
 }
 
+// listenNetwork keeps a socket listening on an IPv6 literal to IPv6 only,
+// so "0.0.0.0" and "[::]" can be listened on side by side.
+// Hostnames and an empty host listen dual-stack.
+func listenNetwork(addr *net.UDPAddr) string {
+	switch {
+	case addr.IP == nil:
+		return "udp"
+	case addr.IP.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// newMultiplexedUDPUtils creates a session connection answering a request
+// over the shared listening connection, release is called once it gets closed
+func newMultiplexedUDPUtils(listener *UDPUtils, request *Packet, release func()) *UDPUtils {
+	return &UDPUtils{
+		addr:       listener.connection.LocalAddr().(*net.UDPAddr),
+		remoteAddr: request.Remote,
+		connection: listener.connection,
+		family:     listener.family,
+		localIP:    request.localIP(),
+		ifIndex:    request.ifIndex,
+		replyOOB:   packetInfoFrom(listener.family, request.localIP(), request.ifIndex),
+		batch:      listener.batch,
+		incoming:   make(chan *[]byte, muxQueueLength),
+		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		logger:     listener.logger,
+		release:    release,
+	}
+}
+
+func (udp *UDPUtils) isMultiplexed() bool {
+	return udp.incoming != nil
+}
+
+// RemoteAddress returns the address the connection talks to,
+// nil for a listening connection
+func (udp *UDPUtils) RemoteAddress() *net.UDPAddr {
+	return udp.remoteAddr
+}
+
+// SetBandwidth shapes both directions of the connection
+// to the given bytes per second, zero is unlimited
+func (udp *UDPUtils) SetBandwidth(bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		udp.throttle = nil
+		return
+	}
+	udp.throttle = NewTokenBucket(float64(bytesPerSecond), bytesPerSecond)
+}
+
 func (udp *UDPUtils) LocalAddress() string {
 	return udp.connection.LocalAddr().String()
 }
+
+// SetTimeout makes reads give up on a silent remote after timeout,
+// sessions sending their last packet again up to retries times
+func (udp *UDPUtils) SetTimeout(timeout time.Duration, retries int) {
+	udp.timeout = timeout
+	udp.retries = retries
+}
+
+// onClose registers a function called once the connection is closed
+func (udp *UDPUtils) onClose(release func()) {
+	udp.release = release
+}
+
+// CloseConnection closes the socket, a multiplexed connection
+// only stops receiving and leaves the shared socket open
 func (udp *UDPUtils) CloseConnection() {
-	udp.connection.Close()
+	udp.closeOnce.Do(func() {
+		if udp.isMultiplexed() {
+			close(udp.closed)
+		} else {
+			udp.connection.Close()
+		}
+		if udp.release != nil {
+			udp.release()
+		}
+	})
+}
+
+// setTrace records the packets sent and received from now on to trace
+func (udp *UDPUtils) setTrace(trace PacketTrace) {
+	local := udp.connection.LocalAddr().(*net.UDPAddr)
+	if udp.localIP != nil {
+		local = &net.UDPAddr{IP: udp.localIP, Port: local.Port}
+	}
+	udp.traceLocal = local
+	udp.trace = trace
 }
 
 func (udp *UDPUtils) WriteToConn(data []byte) error {
-	_, err := udp.connection.Write(data)
+	udp.throttle.Wait(len(data))
+	var err error
+	if udp.batch != nil && udp.isMultiplexed() {
+		err = udp.batch.write(data, udp.replyOOB, udp.remoteAddr)
+	} else if udp.isMultiplexed() {
+		_, _, err = udp.connection.WriteMsgUDP(data, udp.replyOOB, udp.remoteAddr)
+	} else {
+		_, err = udp.connection.Write(data)
+	}
+	if err != nil {
+		udp.logger.Errorf("Error writing to udp: %v", err)
+		return err
+	}
+	// Only packets that went out are traced
+	if udp.trace != nil {
+		udp.trace.Packet(true, udp.traceLocal, udp.remoteAddr, data)
+	}
+	return nil
+}
+
+// send writes a packet of a session, keeping it to be sent again should
+// the client stay silent. Only the goroutine running the session may
+// call it, an abort writing its error packet with WriteToConn instead.
+func (udp *UDPUtils) send(data []byte) error {
+	udp.lastSent = data
+	return udp.WriteToConn(data)
+}
+
+// WriteToAddr writes to a specific address, used by
+// a listening connection that isn't dialed to a remote
+func (udp *UDPUtils) WriteToAddr(data []byte, addr *net.UDPAddr) error {
+	_, err := udp.connection.WriteToUDP(data, addr)
 	if err != nil {
-		logrus.Errorf("Error writing to udp: %v", err)
+		udp.logger.Errorf("Error writing to udp %v: %v", addr, err)
 		return err
 	}
 	return nil
 }
 
+// ReadFromConn reads the next packet of the connection, the data
+// returned is only valid until the next read as its buffer is reused
 func (udp *UDPUtils) ReadFromConn() ([]byte, *net.UDPAddr, error) {
-	length, addr, err := udp.connection.ReadFromUDP(udp.data)
+	data, addr, err := udp.receive()
+	if err == nil && udp.trace != nil {
+		udp.trace.Packet(false, udp.traceLocal, addr, data)
+	}
+	return data, addr, err
+}
+
+// readFromClient reads the next packet of a session. Each time the
+// client stays silent for the timeout the last packet is sent again,
+// as RFC 1350 has it, and once the retries are used up the client
+// is told the transfer timed out.
+func (udp *UDPUtils) readFromClient() ([]byte, error) {
+	for tries := 0; ; tries++ {
+		data, _, err := udp.ReadFromConn()
+		if err != errTimeout {
+			return data, err
+		}
+		if tries == udp.retries || udp.lastSent == nil {
+			msg := fmt.Sprintf("Transfer timed out, no answer from %v in %v", udp.remoteAddr, udp.timeout)
+			if tries > 0 {
+				msg = fmt.Sprintf("%v after %v retries", msg, tries)
+			}
+			sendErrorPacket(UnknownErr, msg, udp)
+			return nil, errors.New(msg)
+		}
+		if err := udp.WriteToConn(udp.lastSent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (udp *UDPUtils) receive() ([]byte, *net.UDPAddr, error) {
+	if udp.isMultiplexed() {
+		return udp.readFromMux()
+	}
+	if udp.timeout > 0 {
+		udp.connection.SetReadDeadline(time.Now().Add(udp.timeout))
+	}
 
+	// A dialed connection only receives from its remote,
+	// reading without the sender address spares allocating it
+	var length int
+	var err error
+	addr := udp.remoteAddr
+	if addr != nil {
+		length, err = udp.connection.Read(*udp.readBuf)
+	} else {
+		length, addr, err = udp.connection.ReadFromUDP(*udp.readBuf)
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return []byte{}, nil, errTimeout
+	}
 	if err != nil {
-		logrus.Errorf("Cannot read from UDP: %v", err)
+		udp.logger.Errorf("Cannot read from UDP: %v", err)
 		return []byte{}, nil, err
 	}
 
-	newData := make([]byte, length)
-	copy(newData, udp.data[0:length])
-	return newData, addr, nil
+	// Holding back received data delays our reply,
+	// which in turn slows the client down
+	udp.throttle.Wait(length)
+
+	return (*udp.readBuf)[:length], addr, nil
+}
+
+// readFromMux waits for the next packet dispatched to the session
+func (udp *UDPUtils) readFromMux() ([]byte, *net.UDPAddr, error) {
+	putPacketBuffer(udp.current)
+	udp.current = nil
+
+	var expired <-chan time.Time
+	if udp.timeout > 0 {
+		udp.resetTimer()
+		expired = udp.timer.C
+	}
+	select {
+	case buf := <-udp.incoming:
+		udp.current = buf
+		udp.throttle.Wait(len(*buf))
+		return *buf, udp.remoteAddr, nil
+	case <-udp.closed:
+		return []byte{}, nil, errors.New("Cannot read from UDP: session closed")
+	case <-expired:
+		return []byte{}, nil, errTimeout
+	}
+}
+
+// resetTimer arms the timer of a multiplexed connection for another
+// timeout, the same timer being reused for every packet
+func (udp *UDPUtils) resetTimer() {
+	if udp.timer == nil {
+		udp.timer = time.NewTimer(udp.timeout)
+		return
+	}
+	if !udp.timer.Stop() {
+		select {
+		case <-udp.timer.C:
+		default:
+		}
+	}
+	udp.timer.Reset(udp.timeout)
+}
+
+// sendBuffer returns the buffer packets are written into before being sent
+func (udp *UDPUtils) sendBuffer() []byte {
+	if udp.sendBuf == nil {
+		udp.sendBuf = getPacketBuffer()
+	}
+	return (*udp.sendBuf)[:0]
+}
+
+// keepSendBuffer holds on to a send buffer that had to grow
+func (udp *UDPUtils) keepSendBuffer(packet []byte) {
+	*udp.sendBuf = packet
+}
+
+// recycle hands the buffers of a closed connection back to the pool,
+// it must be called by the goroutine that was reading and writing it
+func (udp *UDPUtils) recycle() {
+	putPacketBuffer(udp.readBuf)
+	putPacketBuffer(udp.sendBuf)
+	putPacketBuffer(udp.current)
+	udp.readBuf, udp.sendBuf, udp.current = nil, nil, nil
+	udp.lastSent = nil
+	if udp.timer != nil {
+		udp.timer.Stop()
+	}
+
+	for {
+		select {
+		case buf := <-udp.incoming:
+			putPacketBuffer(buf)
+		default:
+			return
+		}
+	}
 }
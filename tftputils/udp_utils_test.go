@@ -38,3 +38,42 @@ func TestUDPReadWrite(t *testing.T) {
 		return
 	}
 }
+
+// BenchmarkBlockRoundTrip sends a data block and reads its ack
+// over loopback, the allocations reported are per block. The session
+// side allocates nothing, the listening socket standing in for the
+// client still allocates the addresses it reads from and writes to.
+func BenchmarkBlockRoundTrip(b *testing.B) {
+	client, err := NewUDPUtils("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.CloseConnection()
+	session, err := NewUDPUtils("", client.LocalAddress())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer session.CloseConnection()
+
+	block := make([]byte, SmallestBlockSize)
+	ack := make([]byte, 0, 4)
+	b.ReportAllocs()
+	b.SetBytes(SmallestBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendDataPacket(uint16(i), block, session); err != nil {
+			b.Fatal(err)
+		}
+		_, addr, err := client.ReadFromConn()
+		if err != nil {
+			b.Fatal(err)
+		}
+		ack = appendAckPacket(ack, uint16(i))
+		if err := client.WriteToAddr(ack, addr); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := session.ReadFromConn(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package tftputils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// upstreamFilenameField is replaced by the filename in an upstream URL
+	upstreamFilenameField = "{filename}"
+	// upstreamRetries is how many times a packet is sent
+	// to an upstream TFTP server before giving up
+	upstreamRetries = 5
+	// defaultUpstreamTimeout is how long an upstream
+	// is waited for when no timeout is given
+	defaultUpstreamTimeout = 5 * time.Second
+)
+
+// Upstream fetches the files missing from the local storage
+type Upstream interface {
+	// Fetch starts downloading a file and returns once the upstream
+	// answered, with the size of the file or -1 when it isn't told
+	Fetch(filename string) (io.ReadCloser, int64, error)
+}
+
+// NewUpstream creates the upstream of a "tftp://host[:port]" address,
+// or of an HTTP URL where {filename} is replaced by the filename
+// requested, the filename is appended to URLs without it
+func NewUpstream(address string, timeout time.Duration) (Upstream, error) {
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed upstream %v: %v", address, err)
+	}
+	switch parsed.Scheme {
+	case "tftp":
+		host := parsed.Host
+		if parsed.Port() == "" {
+			host = net.JoinHostPort(parsed.Hostname(), "69")
+		}
+		return NewTFTPUpstream(host, timeout), nil
+	case "http", "https":
+		return NewHTTPUpstream(address, timeout), nil
+	default:
+		return nil, fmt.Errorf("Unsupported upstream %v, expecting tftp, http or https", address)
+	}
+}
+
+// HTTPUpstream fetches files from an HTTP server
+type HTTPUpstream struct {
+	template string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// NewHTTPUpstream creates an upstream fetching the URL of the template,
+// timeout bounds how long the server takes to answer
+// and how long the download may stall
+func NewHTTPUpstream(template string, timeout time.Duration) *HTTPUpstream {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	return &HTTPUpstream{
+		template: template,
+		timeout:  timeout,
+		client:   &http.Client{Transport: transport},
+	}
+}
+
+// URL returns the URL a file is fetched from, filenames
+// with ".." elements are refused
+func (u *HTTPUpstream) URL(filename string) (string, error) {
+	for _, element := range strings.Split(filename, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("Cannot fetch %v: path leads out of the upstream", filename)
+		}
+	}
+	cleaned := path.Clean("/" + filename)
+	if cleaned == "/" {
+		return "", fmt.Errorf("Cannot fetch %v: no filename", filename)
+	}
+	escaped := strings.TrimPrefix((&url.URL{Path: cleaned}).EscapedPath(), "/")
+	if strings.Contains(u.template, upstreamFilenameField) {
+		return strings.Replace(u.template, upstreamFilenameField, escaped, -1), nil
+	}
+	return strings.TrimSuffix(u.template, "/") + "/" + escaped, nil
+}
+
+func (u *HTTPUpstream) Fetch(filename string) (io.ReadCloser, int64, error) {
+	address, err := u.URL(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := u.client.Get(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, 0, fmt.Errorf("%v does not exist upstream", filename)
+		}
+		return nil, 0, fmt.Errorf("Upstream answered %v for %v", response.Status, filename)
+	}
+	return newIdleBody(response.Body, u.timeout), response.ContentLength, nil
+}
+
+// idleBody fails a download once no data came in for the timeout,
+// closing the body to stop the read waiting for it
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration) *idleBody {
+	b := &idleBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.stalled, 1)
+		body.Close()
+	})
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if atomic.LoadInt32(&b.stalled) == 1 {
+		return n, fmt.Errorf("Upstream sent nothing for %v", b.timeout)
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// TFTPUpstream fetches files from another TFTP server
+type TFTPUpstream struct {
+	address string
+	timeout time.Duration
+}
+
+// NewTFTPUpstream creates an upstream reading from the server at address,
+// waiting up to timeout for every packet before sending again
+func NewTFTPUpstream(address string, timeout time.Duration) *TFTPUpstream {
+	return &TFTPUpstream{
+		address: address,
+		timeout: timeout,
+	}
+}
+
+// Fetch requests the file with the tsize option, a server
+// not supporting options starts sending right away instead
+func (u *TFTPUpstream) Fetch(filename string) (io.ReadCloser, int64, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", u.address)
+	if err != nil {
+		return nil, 0, err
+	}
+	connection, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader := &tftpReader{
+		connection: connection,
+		peer:       serverAddr,
+		timeout:    u.timeout,
+		block:      1,
+		buf:        make([]byte, SmallestBlockSize+4),
+	}
+
+	size, err := reader.request(filename)
+	if err != nil {
+		connection.Close()
+		return nil, 0, err
+	}
+	return reader, size, nil
+}
+
+// tftpReader reads a file from a TFTP server block by block,
+// acking every block as it is read
+type tftpReader struct {
+	connection *net.UDPConn
+	peer       *net.UDPAddr
+	timeout    time.Duration
+	// lastSent is sent again when the server goes quiet
+	lastSent []byte
+	block    uint16
+	pending  []byte
+	buf      []byte
+	done     bool
+}
+
+// request sends the read request and waits for the
+// server to answer, returning the size of the file if told
+func (r *tftpReader) request(filename string) (int64, error) {
+	err := r.send(createRequestPacket(RRQ, filename, OCTET, "tsize", "0"), r.peer)
+	if err != nil {
+		return 0, err
+	}
+	packet, err := r.receive(true)
+	if err != nil {
+		return 0, err
+	}
+
+	opCode, _ := getOpCode(packet)
+	if opCode != OACK {
+		return -1, r.accept(packet)
+	}
+	size, err := strconv.ParseInt(getOptionAck(packet)["tsize"], 10, 64)
+	if err != nil || size < 0 {
+		size = -1
+	}
+	return size, r.send(createAckPacket(0), r.peer)
+}
+
+// receive waits for the next packet from the server,
+// the first one telling the port the server talks from
+func (r *tftpReader) receive(first bool) ([]byte, error) {
+	for tries := 1; ; {
+		r.connection.SetReadDeadline(time.Now().Add(r.timeout))
+		length, addr, err := r.connection.ReadFromUDP(r.buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if tries == upstreamRetries {
+				return nil, fmt.Errorf("Upstream %v timed out", r.peer)
+			}
+			tries++
+			r.send(r.lastSent, r.peer)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			r.peer = addr
+		} else if !addr.IP.Equal(r.peer.IP) || addr.Port != r.peer.Port {
+			continue
+		}
+
+		packet := r.buf[:length]
+		opCode, err := getOpCode(packet)
+		if err != nil {
+			return nil, err
+		}
+		if opCode == ERROR {
+			message, _ := getErrorMessage(packet)
+			if len(packet) > 3 && packet[3] == FileNotFoundErr {
+				return nil, fmt.Errorf("File does not exist upstream: %v", message)
+			}
+			return nil, fmt.Errorf("Upstream failed: %v", message)
+		}
+		return packet, nil
+	}
+}
+
+// accept takes the data of a block, acking it
+func (r *tftpReader) accept(packet []byte) error {
+	opCode, _ := getOpCode(packet)
+	block, err := getAck(packet)
+	if err != nil || opCode != DATA || block != r.block {
+		return fmt.Errorf("Upstream sent an unexpected packet: %v", opCode)
+	}
+	data, _ := getData(packet)
+	r.pending = data
+	r.done = len(data) < SmallestBlockSize
+	r.block++
+	return r.send(createAckPacket(block), r.peer)
+}
+
+func (r *tftpReader) send(packet []byte, addr *net.UDPAddr) error {
+	r.lastSent = packet
+	_, err := r.connection.WriteToUDP(packet, addr)
+	return err
+}
+
+func (r *tftpReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		packet, err := r.receive(false)
+		if err != nil {
+			return 0, err
+		}
+		// A packet sent again as our ack got lost is acked again
+		if opCode, _ := getOpCode(packet); opCode == OACK {
+			r.send(createAckPacket(0), r.peer)
+			continue
+		}
+		if block, _ := getAck(packet); block == r.block-1 {
+			r.send(createAckPacket(block), r.peer)
+			continue
+		}
+		if err := r.accept(packet); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *tftpReader) Close() error {
+	return r.connection.Close()
+}
+
+// streamBuffer holds a file being downloaded, reads past what was
+// downloaded so far wait for the rest to come in
+type streamBuffer struct {
+	data []byte
+	size int64
+	done bool
+	err  error
+	cond *sync.Cond
+}
+
+func newStreamBuffer(size int64) *streamBuffer {
+	return &streamBuffer{
+		size: size,
+		cond: sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	b.cond.L.Lock()
+	b.data = append(b.data, p...)
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish ends the download, failing it when
+// the size announced was not the one received
+func (b *streamBuffer) finish(err error) {
+	b.cond.L.Lock()
+	if err == nil && b.size >= 0 && int64(len(b.data)) != b.size {
+		err = fmt.Errorf("Upstream sent %v bytes instead of %v", len(b.data), b.size)
+	}
+	b.done = true
+	b.err = err
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *streamBuffer) ReadAt(p []byte, off int64) (int, error) {
+	defer b.cond.L.Unlock()
+	b.cond.L.Lock()
+
+	for int64(len(b.data)) < off+int64(len(p)) && !b.done {
+		b.cond.Wait()
+	}
+	if off >= int64(len(b.data)) {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		if b.err != nil {
+			return n, b.err
+		}
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// download is a file being fetched from upstream,
+// ready is closed once the upstream answered
+type download struct {
+	ready   chan struct{}
+	content *streamBuffer
+	err     error
+}
+
+// UpstreamStorage fetches the files missing from a storage from an
+// upstream server, streaming them to clients as they come in.
+// Clients asking for a file being fetched share the download.
+// With caching, fetched files are then stored in the storage.
+// Only Get reaches the upstream, DoesFileExist and Files
+// tell about the files of the storage alone.
+type UpstreamStorage struct {
+	Storage
+	upstream  Upstream
+	cache     bool
+	downloads map[string]*download
+	logger    Logger
+	mutex     *sync.Mutex
+}
+
+func NewUpstreamStorage(storage Storage, upstream Upstream, cache bool) *UpstreamStorage {
+	return &UpstreamStorage{
+		Storage:   storage,
+		upstream:  upstream,
+		cache:     cache,
+		downloads: make(map[string]*download),
+		logger:    defaultLogger,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Get returns the file of the storage, or the file fetched from upstream
+func (us *UpstreamStorage) Get(filename string) (*FileObject, error) {
+	us.mutex.Lock()
+	fetch, ok := us.downloads[filename]
+	if !ok && us.Storage.DoesFileExist(filename) {
+		us.mutex.Unlock()
+		return us.Storage.Get(filename)
+	}
+	if !ok {
+		fetch = &download{ready: make(chan struct{})}
+		us.downloads[filename] = fetch
+		go us.download(filename, fetch)
+	}
+	us.mutex.Unlock()
+
+	<-fetch.ready
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	return NewFileObjectReaderAt(filename, fetch.content, fetch.content.size), nil
+}
+
+// download fetches a file from upstream, a file of unknown size
+// is only ready once it was fetched whole
+func (us *UpstreamStorage) download(filename string, fetch *download) {
+	us.logger.Infof("Fetching %v from upstream", filename)
+	body, size, err := us.upstream.Fetch(filename)
+	if err != nil {
+		fetch.err = err
+		us.mutex.Lock()
+		delete(us.downloads, filename)
+		us.mutex.Unlock()
+		close(fetch.ready)
+		return
+	}
+	defer body.Close()
+
+	fetch.content = newStreamBuffer(size)
+	if size >= 0 {
+		close(fetch.ready)
+	}
+	_, err = io.Copy(fetch.content, body)
+	if size < 0 {
+		fetch.content.size = int64(len(fetch.content.data))
+		fetch.err = err
+		close(fetch.ready)
+	}
+	fetch.content.finish(err)
+
+	// Clients keep sharing the download until it is stored
+	defer func() {
+		us.mutex.Lock()
+		delete(us.downloads, filename)
+		us.mutex.Unlock()
+	}()
+	if fetch.content.err != nil {
+		us.logger.Errorf("Cannot fetch %v from upstream: %v", filename, fetch.content.err)
+		return
+	}
+	if !us.cache {
+		return
+	}
+	file := NewFileObject(filename, fetch.content.data)
+	file.SetMetadata(FileMetadata{Mode: "upstream"})
+	if err := us.Storage.Put(file); err != nil {
+		us.logger.Errorf("Cannot store %v fetched from upstream: %v", filename, err)
+	}
+}
+
+// ReserveRead and ReleaseRead pass reads in progress on to the wrapped storage
+func (us *UpstreamStorage) ReserveRead(filename string) error {
+	return reserveRead(us.Storage, filename)
+}
+
+func (us *UpstreamStorage) ReleaseRead(filename string) {
+	releaseRead(us.Storage, filename)
+}
+
+// RecordRead passes completed reads on to the wrapped storage
+func (us *UpstreamStorage) RecordRead(filename string) {
+	recordRead(us.Storage, filename)
+}
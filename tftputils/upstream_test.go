@@ -0,0 +1,180 @@
+package tftputils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedUpstream serves files from memory once the gate is opened,
+// counting the fetches
+type gatedUpstream struct {
+	files   map[string][]byte
+	gate    chan struct{}
+	fetches int
+	mutex   sync.Mutex
+}
+
+func (u *gatedUpstream) Fetch(filename string) (io.ReadCloser, int64, error) {
+	u.mutex.Lock()
+	u.fetches++
+	u.mutex.Unlock()
+	data, ok := u.files[filename]
+	if !ok {
+		return nil, 0, fmt.Errorf("%v does not exist upstream", filename)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write(data[:1])
+		<-u.gate
+		writer.Write(data[1:])
+		writer.Close()
+	}()
+	return reader, int64(len(data)), nil
+}
+
+func TestHTTPUpstreamURL(t *testing.T) {
+	upstream := NewHTTPUpstream("http://hq/images/{filename}?site=a", time.Second)
+	address, err := upstream.URL("boot/pxe linux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://hq/images/boot/pxe%20linux.0?site=a", address)
+	upstream = NewHTTPUpstream("http://hq/images/", time.Second)
+	address, err = upstream.URL("/boot//./pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://hq/images/boot/pxelinux.0", address)
+	for _, filename := range []string{"../secret", "boot/../../secret", "..", "", "/"} {
+		_, err = upstream.URL(filename)
+		assert.NotNil(t, err, filename)
+	}
+
+	_, err = NewUpstream("ftp://hq", 0)
+	assert.NotNil(t, err)
+	tftp, err := NewUpstream("tftp://hq", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hq:69", tftp.(*TFTPUpstream).address)
+}
+
+func TestUpstreamStorageHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/boot/pxelinux.0" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("boot"))
+	}))
+	defer server.Close()
+
+	local := NewFileStore()
+	storage := NewUpstreamStorage(local, NewHTTPUpstream(server.URL+"/images/{filename}", time.Second), true)
+	file, err := storage.Get("boot/pxelinux.0")
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(file.NewReader())
+	assert.Nil(t, err)
+	assert.Equal(t, "boot", string(content))
+
+	_, err = storage.Get("missing")
+	assert.NotNil(t, err)
+	assert.False(t, storage.DoesFileExist("missing"))
+
+	assert.Eventually(t, func() bool {
+		return local.DoesFileExist("boot/pxelinux.0")
+	}, time.Second, time.Millisecond)
+	file, err = local.Get("boot/pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "upstream", file.Metadata().Mode)
+}
+
+func TestUpstreamStorageStreams(t *testing.T) {
+	upstream := &gatedUpstream{
+		files: map[string][]byte{"image.iso": []byte("streamed")},
+		gate:  make(chan struct{}),
+	}
+	storage := NewUpstreamStorage(NewFileStore(), upstream, false)
+
+	// The file is served before it is fetched whole,
+	// and clients asking meanwhile share the download
+	first, err := storage.Get("image.iso")
+	assert.Nil(t, err)
+	second, err := storage.Get("image.iso")
+	assert.Nil(t, err)
+	block := make([]byte, 1)
+	_, err = first.NewReader().ReadAt(block, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "s", string(block))
+
+	close(upstream.gate)
+	content, err := ioutil.ReadAll(second.NewReader())
+	assert.Nil(t, err)
+	assert.Equal(t, "streamed", string(content))
+	assert.Equal(t, 1, upstream.fetches)
+	assert.False(t, storage.Storage.DoesFileExist("image.iso"))
+}
+
+func TestUpstreamStorageStalledDownload(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("stal"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	storage := NewUpstreamStorage(NewFileStore(), NewHTTPUpstream(server.URL, 50*time.Millisecond), false)
+	file, err := storage.Get("image.iso")
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(file.NewReader())
+	assert.NotNil(t, err)
+
+	// The failed download is dropped, the next client fetches again
+	assert.Eventually(t, func() bool {
+		storage.mutex.Lock()
+		defer storage.mutex.Unlock()
+		return len(storage.downloads) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestStreamBufferShortDownload(t *testing.T) {
+	buffer := newStreamBuffer(10)
+	buffer.Write([]byte("short"))
+	buffer.finish(nil)
+	block := make([]byte, 10)
+	n, err := buffer.ReadAt(block, 0)
+	assert.Equal(t, 5, n)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestTFTPUpstream(t *testing.T) {
+	server, err := NewServeSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Shutdown()
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	assert.Nil(t, server.fileStorage.Put(NewFileObject("boot/pxelinux.0", data)))
+
+	upstream := NewTFTPUpstream(server.LocalAddresses()[0], time.Second)
+	body, size, err := upstream.Fetch("boot/pxelinux.0")
+	if assert.Nil(t, err) {
+		// The server doesn't answer options, the size is unknown
+		assert.Equal(t, int64(-1), size)
+		content, err := ioutil.ReadAll(body)
+		assert.Nil(t, err)
+		assert.Equal(t, data, content)
+		body.Close()
+	}
+
+	_, _, err = upstream.Fetch("missing")
+	assert.NotNil(t, err)
+}
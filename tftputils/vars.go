@@ -6,6 +6,7 @@ package tftputils
 // 	3     Data (DATA)
 // 	4     Acknowledgment (ACK)
 // 	5     Error (ERROR)
+// 	6     Option Acknowledgment (OACK)
 const (
 	UNKNOWNOP = iota
 	RRQ
@@ -13,6 +14,7 @@ const (
 	DATA
 	ACK
 	ERROR
+	OACK
 )
 
 const (
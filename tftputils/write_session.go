@@ -1,29 +1,29 @@
 package tftputils
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"net"
-
-	"github.com/sirupsen/logrus"
+	"hash"
+	"hash/crc32"
 )
 
 // WriteSession holds necessary info about how to receive file data
 // from the client
 type WriteSession struct {
 	udpUtils    *UDPUtils
-	fileStorage *FileStore
+	fileStorage Storage
 	tempBuf     []byte
+	digest      hash.Hash
+	crc32       hash.Hash32
 	reqInfo     *RequestInfo
 	blockLoc    uint16
+	transfer    *Transfer
 }
 
-func NewWriteSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDPAddr) (*WriteSession, error) {
-	udpUtils, err := NewUDPUtils("", remoteAddr.String())
-	if err != nil {
-		return nil, err
-	}
-
+// NewWriteSession validates the request and prepares a session
+// talking to the client over udpUtils
+func NewWriteSession(fileS Storage, reqInfo *RequestInfo, udpUtils *UDPUtils) (*WriteSession, error) {
 	ok, err := validateWriteRequest(fileS, reqInfo, udpUtils)
 	if err != nil {
 		return nil, err
@@ -36,27 +36,54 @@ func NewWriteSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDP
 		udpUtils:    udpUtils,
 		fileStorage: fileS,
 		tempBuf:     []byte{},
+		digest:      sha256.New(),
+		crc32:       crc32.NewIEEE(),
 		reqInfo:     reqInfo,
 		blockLoc:    0,
 	}, nil
 }
 
-// SpawnWriteSession dials up to the address provided and
+// SpawnWriteSession talks to the client over the connection provided and
 // starts sending ack packets when file data is received block by block.
-func SpawnWriteSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.UDPAddr) error {
-	writer, err := NewWriteSession(fileS, reqInfo, remoteAddr)
+func SpawnWriteSession(
+	fileS Storage,
+	reqInfo *RequestInfo,
+	udpUtils *UDPUtils,
+	transfer *Transfer) (err error) {
+
+	// close connection at the end of session
+	defer udpUtils.CloseConnection()
+
+	var writer *WriteSession
+	record := newAuditRecord(WriteDirection, reqInfo)
+	defer func() {
+		if writer == nil {
+			reqInfo.auditSession(record, transfer, udpUtils, 0, nil, err)
+			return
+		}
+		reqInfo.auditSession(record, transfer, udpUtils, int64(len(writer.tempBuf)), func() []byte {
+			return writer.digest.Sum(nil)
+		}, err)
+	}()
+
+	writer, err = NewWriteSession(fileS, reqInfo, udpUtils)
 
 	if err != nil {
 		return err
 	}
-	defer writer.udpUtils.CloseConnection()
 
-	logrus.Infof("W: Starting a writing session for %v in %v mode",
-		reqInfo.filename, reqInfo.mode)
+	writer.transfer = transfer
+	if size, ok := reqInfo.transferSize(); ok {
+		transfer.setSize(size)
+	}
+	transfer.onAbort(writer.abort)
+
+	reqInfo.log().Infof("Starting a writing session for %v in %v mode from %v",
+		reqInfo.filename, reqInfo.mode, reqInfo.remote)
 
 	sendAckPacket(writer.blockLoc, writer.udpUtils)
 	for {
-		data, _, err := writer.udpUtils.ReadFromConn()
+		data, err := writer.udpUtils.readFromClient()
 		if err != nil {
 			return err
 		}
@@ -65,23 +92,30 @@ func SpawnWriteSession(fileS *FileStore, reqInfo *RequestInfo, remoteAddr *net.U
 			return err
 		}
 		if done {
-			// Once all data are received, store it on the file stoarge.
-			err := writer.storeFile()
-			logrus.Infof("W: Done transferring data from %v to server", reqInfo.filename)
-			return err
+			reqInfo.log().Infof("Done transferring data from %v to server", reqInfo.filename)
+			return nil
 		}
 	}
 }
 
 // validateReadRequest validates if we can store file in the server (file hasn't existed) in the server
 // and the mode is supported, otherwise send an error message to the client.
-func validateWriteRequest(fileS *FileStore, reqInfo *RequestInfo, udpUtils *UDPUtils) (bool, error) {
+func validateWriteRequest(fileS Storage, reqInfo *RequestInfo, udpUtils *UDPUtils) (bool, error) {
 	if fileS.DoesFileExist(reqInfo.filename) {
-		msg := fmt.Sprintf("W: File %v exists in the server", reqInfo.filename)
-		logrus.Error(msg)
+		msg := fmt.Sprintf("File %v exists in the server", reqInfo.filename)
+		reqInfo.log().Errorf("%v", msg)
 		return false, sendErrorPacket(FileExistsErr, msg, udpUtils)
 	}
-	return validateModeAndNotify(reqInfo.mode, udpUtils)
+
+	// Refuse upfront when the client tells us the size of the file
+	if size, ok := reqInfo.transferSize(); ok {
+		if err := fileS.CheckQuota(size); err != nil {
+			msg := fmt.Sprintf("Cannot store %v: %v", reqInfo.filename, err)
+			reqInfo.log().Errorf("%v", msg)
+			return false, sendErrorPacket(DiskFullErr, msg, udpUtils)
+		}
+	}
+	return validateModeAndNotify(reqInfo.mode, udpUtils, reqInfo.log())
 }
 
 // ResolvePacket determines from initial request info
@@ -96,13 +130,13 @@ func (ws *WriteSession) ResolvePacket(packet []byte) (bool, error) {
 	case DATA:
 		return ws.handleData(packet)
 	case ERROR:
-		err := handleError(packet)
+		err := handleError(packet, ws.udpUtils, ws.reqInfo.log())
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	default:
-		return false, fmt.Errorf("W: Opcode unknown or currently unsupported: %v", opCode)
+		return false, fmt.Errorf("Opcode unknown or currently unsupported: %v", opCode)
 	}
 }
 
@@ -117,9 +151,12 @@ func (ws *WriteSession) handleData(packet []byte) (bool, error) {
 
 	if blockFromClient == ws.blockLoc+1 {
 		ws.blockLoc++
+	} else if blockFromClient == ws.blockLoc {
+		// The client sent a block again as our ack got lost
+		return false, sendAckPacket(ws.blockLoc, ws.udpUtils)
 	} else {
 		return false,
-			fmt.Errorf("W: Error reading the next block: %v", blockFromClient)
+			fmt.Errorf("Error reading the next block: %v", blockFromClient)
 	}
 
 	data, err := getData(packet)
@@ -128,16 +165,49 @@ func (ws *WriteSession) handleData(packet []byte) (bool, error) {
 	}
 
 	ws.storeData(data)
+	ws.transfer.setTransferred(int64(len(ws.tempBuf)))
+
+	// Stop a runaway upload as soon as it no longer fits,
+	// instead of buffering it until the last block
+	err = ws.fileStorage.CheckQuota(int64(len(ws.tempBuf)))
+	if err != nil {
+		msg := fmt.Sprintf("Cannot store %v: %v", ws.reqInfo.filename, err)
+		ws.reqInfo.log().Errorf("%v", msg)
+		sendErrorPacket(DiskFullErr, msg, ws.udpUtils)
+		return false, err
+	}
+
+	// The file is stored before the last block is acked,
+	// so the client learns when it couldn't be
+	last := len(packet) < SmallestBlockSize
+	if last {
+		if err := ws.storeFile(); err != nil {
+			msg := fmt.Sprintf("Cannot store %v: %v", ws.reqInfo.filename, err)
+			ws.reqInfo.log().Errorf("%v", msg)
+			sendErrorPacket(ws.storeErrorCode(err), msg, ws.udpUtils)
+			return false, err
+		}
+	}
 
 	err = sendAckPacket(ws.blockLoc, ws.udpUtils)
 	if err != nil {
 		return false, err
 	}
+	return last, nil
+}
 
-	if len(packet) < SmallestBlockSize {
-		return true, nil
+// storeErrorCode tells the client why storing a file failed: the
+// storage being full, or another upload of the same name storing first
+func (ws *WriteSession) storeErrorCode(err error) uint8 {
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		return DiskFullErr
+	case ws.fileStorage.DoesFileExist(ws.reqInfo.filename):
+		return FileExistsErr
+	default:
+		return UnknownErr
 	}
-	return false, nil
 }
 
 // storeData stores block data from client
@@ -146,11 +216,28 @@ func (ws *WriteSession) handleData(packet []byte) (bool, error) {
 func (ws *WriteSession) storeData(data []byte) {
 	newData := append(ws.tempBuf, data...)
 	ws.tempBuf = newData
+	ws.digest.Write(data)
+	ws.crc32.Write(data)
+}
+
+// abort tells the client the transfer is over and closes
+// the connection, which ends the session loop
+func (ws *WriteSession) abort() {
+	sendErrorPacket(UnknownErr, "Transfer aborted by the server", ws.udpUtils)
+	ws.udpUtils.CloseConnection()
 }
 
 // storeFile stores temporary buffer data
 // to the file storage,
 func (ws *WriteSession) storeFile() error {
 	newFile := NewFileObject(ws.reqInfo.filename, ws.tempBuf)
+	var digest [sha256.Size]byte
+	copy(digest[:], ws.digest.Sum(nil))
+	newFile.setChecksums(digest, ws.crc32.Sum32())
+	metadata := FileMetadata{Mode: ws.reqInfo.mode}
+	if ws.udpUtils != nil && ws.udpUtils.RemoteAddress() != nil {
+		metadata.Uploader = ws.udpUtils.RemoteAddress().IP.String()
+	}
+	newFile.SetMetadata(metadata)
 	return ws.fileStorage.Put(newFile)
 }
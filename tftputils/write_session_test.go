@@ -0,0 +1,75 @@
+package tftputils
+
+import (
+	"crypto/sha256"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSessionRecordsChecksums(t *testing.T) {
+	fileStorage := NewFileStore()
+	writer := &WriteSession{
+		fileStorage: fileStorage,
+		digest:      sha256.New(),
+		crc32:       crc32.NewIEEE(),
+		reqInfo:     &RequestInfo{filename: "config.txt", mode: OCTET},
+	}
+	writer.storeData([]byte("hello "))
+	writer.storeData([]byte("world"))
+	assert.Nil(t, writer.storeFile())
+
+	file, err := fileStorage.Get("config.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, sha256.Sum256([]byte("hello world")), file.SHA256())
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("hello world")), file.CRC32())
+}
+
+func TestWriteSessionRefusesLastBlockNotStored(t *testing.T) {
+	for _, test := range []struct {
+		limits StoreLimits
+		code   uint8
+	}{
+		{StoreLimits{MaxFiles: 1}, DiskFullErr},
+		{StoreLimits{}, FileExistsErr},
+	} {
+		fileStorage := NewFileStore()
+		fileStorage.SetLimits(test.limits)
+		client, err := NewUDPUtils("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := NewUDPUtils("", client.LocalAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetTimeout(time.Second, 0)
+
+		reqInfo := &RequestInfo{filename: "config.txt", mode: OCTET}
+		done := make(chan error)
+		go func() {
+			done <- SpawnWriteSession(fileStorage, reqInfo, session, NewTransfer(WriteDirection, reqInfo, nil))
+		}()
+		_, addr, err := client.ReadFromConn()
+		assert.Nil(t, err)
+
+		// Another upload stores first while this one is running
+		other := "config.txt"
+		if test.code == DiskFullErr {
+			other = "other.txt"
+		}
+		assert.Nil(t, fileStorage.Put(NewFileObject(other, []byte("first"))))
+		client.WriteToAddr(createDataPacket(1, []byte("second")), addr)
+
+		packet, _, err := client.ReadFromConn()
+		assert.Nil(t, err)
+		opCode, _ := getOpCode(packet)
+		if assert.Equal(t, uint16(ERROR), opCode) {
+			assert.Equal(t, test.code, packet[3])
+		}
+		assert.NotNil(t, <-done)
+		client.CloseConnection()
+	}
+}